@@ -0,0 +1,156 @@
+package enn
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// An Identity is who a session is authenticated as.
+type Identity struct {
+	User string
+	// Role is "user", "mod" or "admin", empty means "user".
+	Role string
+}
+
+// An Authenticator checks the credentials sent with AUTHINFO. It returns
+// ErrAuthRejected for bad credentials and other errors when it could not
+// tell, e.g. a file or program is missing.
+type Authenticator interface {
+	Authenticate(user, pass string) (*Identity, error)
+}
+
+// HtpasswdFile authenticates against an htpasswd style file of user:hash
+// lines, hashes being bcrypt ($2y$) or {SHA}. An optional third field
+// user:hash:role gives the role. The file is reloaded when it changes.
+type HtpasswdFile struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string][2]string
+}
+
+func (h *HtpasswdFile) load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, err := os.Stat(h.Path)
+	if err != nil {
+		return err
+	}
+	if h.users != nil && st.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(h.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := map[string][2]string{}
+	for s := bufio.NewScanner(f); s.Scan(); {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		role := ""
+		if len(parts) == 3 {
+			role = parts[2]
+		}
+		users[parts[0]] = [2]string{parts[1], role}
+	}
+	h.users, h.modTime = users, st.ModTime()
+	return nil
+}
+
+func (h *HtpasswdFile) Authenticate(user, pass string) (*Identity, error) {
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	u, ok := h.users[user]
+	h.mu.Unlock()
+	if !ok || !checkHtpasswd(u[0], pass) {
+		return nil, ErrAuthRejected
+	}
+	return &Identity{User: user, Role: u[1]}, nil
+}
+
+func checkHtpasswd(hash, pass string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return false
+}
+
+// ExecAuthenticator runs a program with "user\npass\n" on its stdin. Exit
+// code 0 accepts the credentials, the first line of the output, if any,
+// being the role. Exit code 1 rejects them, anything else is an error.
+type ExecAuthenticator struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration
+}
+
+func (e *ExecAuthenticator) Authenticate(user, pass string) (*Identity, error) {
+	if strings.ContainsAny(user+pass, "\r\n") {
+		return nil, ErrAuthRejected
+	}
+	timeout := e.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.Path, e.Args...)
+	cmd.Stdin = strings.NewReader(user + "\n" + pass + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 {
+			return nil, ErrAuthRejected
+		}
+		return nil, fmt.Errorf("auth program %s: %v", e.Path, err)
+	}
+	role := string(bytes.TrimSpace(bytes.SplitN(out, []byte("\n"), 2)[0]))
+	return &Identity{User: user, Role: role}, nil
+}
+
+// ChainAuthenticator asks each authenticator in turn until one accepts the
+// credentials. If none does, the first error other than ErrAuthRejected is
+// returned, or ErrAuthRejected.
+type ChainAuthenticator []Authenticator
+
+func (c ChainAuthenticator) Authenticate(user, pass string) (*Identity, error) {
+	var rv error = ErrAuthRejected
+	for _, a := range c {
+		id, err := a.Authenticate(user, pass)
+		if err == nil {
+			return id, nil
+		}
+		if err != ErrAuthRejected && rv == ErrAuthRejected {
+			rv = err
+		}
+	}
+	return nil, rv
+}
@@ -0,0 +1,83 @@
+package enn
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type staticAuth struct {
+	id  *Identity
+	err error
+}
+
+func (a staticAuth) Authenticate(user, pass string) (*Identity, error) { return a.id, a.err }
+
+func TestHtpasswd(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "enn")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+
+	// alice:secret (bcrypt), bob:secret ({SHA}) as a mod
+	ioutil.WriteFile(path, []byte("# comment\n"+
+		"alice:$2y$05$K3AsHNkbCiqTZqMyiIUxjuVnE8gjTsRAMJafb1/YL40DnO6TPgaJK\n"+
+		"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=:mod\n"), 0644)
+	h := &HtpasswdFile{Path: path}
+
+	if id, err := h.Authenticate("alice", "secret"); err != nil || id.User != "alice" || id.Role != "" {
+		t.Fatal(id, err)
+	}
+	if id, err := h.Authenticate("bob", "secret"); err != nil || id.Role != "mod" {
+		t.Fatal(id, err)
+	}
+	for _, c := range [][2]string{{"alice", "bad"}, {"bob", "bad"}, {"carol", "secret"}} {
+		if _, err := h.Authenticate(c[0], c[1]); err != ErrAuthRejected {
+			t.Fatal(c, err)
+		}
+	}
+	if _, err := (&HtpasswdFile{Path: path + ".missing"}).Authenticate("alice", "secret"); err == nil || err == ErrAuthRejected {
+		t.Fatal(err)
+	}
+}
+
+func TestExecAuthenticator(t *testing.T) {
+	e := &ExecAuthenticator{Path: "sh", Args: []string{"-c", `read u; read p
+[ "$p" = secret ] || exit 1; [ "$u" = boom ] && exit 2; [ "$u" = admin ] && echo admin; exit 0`}}
+
+	if id, err := e.Authenticate("alice", "secret"); err != nil || id.User != "alice" || id.Role != "" {
+		t.Fatal(id, err)
+	}
+	if id, err := e.Authenticate("admin", "secret"); err != nil || id.Role != "admin" {
+		t.Fatal(id, err)
+	}
+	if _, err := e.Authenticate("alice", "bad"); err != ErrAuthRejected {
+		t.Fatal(err)
+	}
+	if _, err := e.Authenticate("alice", "secret\nx"); err != ErrAuthRejected {
+		t.Fatal(err)
+	}
+	if _, err := e.Authenticate("boom", "secret"); err == nil || err == ErrAuthRejected {
+		t.Fatal(err)
+	}
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	boom := errors.New("boom")
+	reject := staticAuth{err: ErrAuthRejected}
+	accept := staticAuth{id: &Identity{User: "a"}}
+
+	if id, err := (ChainAuthenticator{reject, staticAuth{err: boom}, accept}).Authenticate("a", "b"); err != nil || id.User != "a" {
+		t.Fatal(id, err)
+	}
+	if _, err := (ChainAuthenticator{reject, staticAuth{err: boom}, reject}).Authenticate("a", "b"); err != boom {
+		t.Fatal(err)
+	}
+	if _, err := (ChainAuthenticator{reject, reject}).Authenticate("a", "b"); err != ErrAuthRejected {
+		t.Fatal(err)
+	}
+	if _, err := (ChainAuthenticator{}).Authenticate("a", "b"); err != ErrAuthRejected {
+		t.Fatal(err)
+	}
+}
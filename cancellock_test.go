@@ -0,0 +1,27 @@
+package enn
+
+import "testing"
+
+func TestCancelLock(t *testing.T) {
+	secret := []byte("secret")
+	lock := MakeCancelLock(secret, "<a@b>", "joe") + " sha1:bm9wZQ=="
+	key := "sha256:" + MakeCancelKey(secret, "<a@b>", "joe")
+
+	if !VerifyCancelKey(lock, key) {
+		t.Fatalf("key %q doesn't match %q", key, lock)
+	}
+	if !VerifyCancelKey(lock, "sha1:x "+key) {
+		t.Fatal("key among others not matched")
+	}
+	for _, bad := range []string{
+		"",
+		"sha256:" + MakeCancelKey(secret, "<a@b>", "eve"),
+		"sha256:" + MakeCancelKey(secret, "<c@d>", "joe"),
+		"md5:" + MakeCancelKey(secret, "<a@b>", "joe"),
+		MakeCancelKey(secret, "<a@b>", "joe"),
+	} {
+		if VerifyCancelKey(lock, bad) {
+			t.Fatalf("bad key %q accepted", bad)
+		}
+	}
+}
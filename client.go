@@ -0,0 +1,216 @@
+package enn
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// A Client is a minimal NNTP client, enough to feed articles to peers and
+// to read articles from an upstream server.
+type Client struct {
+	*textproto.Conn
+	conn net.Conn
+
+	// Banner is the server's greeting line.
+	Banner string
+	// Timeout, when set, bounds every command exchange.
+	Timeout time.Duration
+}
+
+// Dial connects to the NNTP server at addr and reads its greeting.
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient wraps an established connection and reads the server's greeting.
+func NewClient(conn net.Conn, timeout time.Duration) (*Client, error) {
+	c := &Client{
+		Conn:    textproto.NewConn(conn),
+		conn:    conn,
+		Timeout: timeout,
+	}
+	c.deadline()
+	_, msg, err := c.ReadCodeLine(20)
+	if err != nil {
+		return nil, clientError(err)
+	}
+	c.Banner = msg
+	return c, nil
+}
+
+func (c *Client) deadline() {
+	if c.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+}
+
+// clientError turns an unexpected response into an NNTPError carrying the
+// server's code, so callers can tell "retry later" from "rejected".
+func clientError(err error) error {
+	if e, ok := err.(*textproto.Error); ok {
+		return &NNTPError{e.Code, e.Msg}
+	}
+	return err
+}
+
+// Cmd sends a command and reads a response line with the expected code.
+func (c *Client) Cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	c.deadline()
+	if err := c.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.ReadCodeLine(expect)
+	return code, msg, clientError(err)
+}
+
+// ModeStream switches the connection to streaming mode (RFC 4644).
+func (c *Client) ModeStream() error {
+	_, _, err := c.Cmd(203, "MODE STREAM")
+	return err
+}
+
+// IHave offers an article with IHAVE and sends it if the server wants it.
+// A 435, 436 or 437 answer is returned as an NNTPError.
+func (c *Client) IHave(a *Article) error {
+	if _, _, err := c.Cmd(335, "IHAVE %s", a.MessageID()); err != nil {
+		return err
+	}
+	if err := c.writeArticle(a); err != nil {
+		return err
+	}
+	_, _, err := c.ReadCodeLine(235)
+	return clientError(err)
+}
+
+// Check asks a streaming server whether it wants an article. A 438 or 431
+// answer is returned as an NNTPError.
+func (c *Client) Check(msgID string) error {
+	if err := c.SendCheck(msgID); err != nil {
+		return err
+	}
+	return c.streamResult(238)
+}
+
+// TakeThis sends an article to a streaming server. A 439 answer is
+// returned as an NNTPError.
+func (c *Client) TakeThis(a *Article) error {
+	if err := c.SendTakeThis(a); err != nil {
+		return err
+	}
+	return c.streamResult(239)
+}
+
+// SendCheck sends CHECK without waiting for the answer, read later with
+// StreamResponse. Streaming servers answer commands in order, so several
+// can be in flight (RFC 4644 section 2.5).
+func (c *Client) SendCheck(msgID string) error {
+	c.deadline()
+	return c.PrintfLine("CHECK %s", msgID)
+}
+
+// SendTakeThis sends TAKETHIS and the article without waiting for the
+// answer, read later with StreamResponse.
+func (c *Client) SendTakeThis(a *Article) error {
+	c.deadline()
+	if err := c.PrintfLine("TAKETHIS %s", a.MessageID()); err != nil {
+		return err
+	}
+	return c.writeArticle(a)
+}
+
+// StreamResponse reads the answer to the oldest CHECK or TAKETHIS in
+// flight, returning its code and the Message-ID it is about.
+func (c *Client) StreamResponse() (int, string, error) {
+	c.deadline()
+	code, msg, err := c.ReadCodeLine(0)
+	if err != nil {
+		return 0, "", clientError(err)
+	}
+	msgID := msg
+	if i := strings.IndexByte(msg, ' '); i > -1 {
+		msgID = msg[:i]
+	}
+	return code, msgID, nil
+}
+
+func (c *Client) streamResult(expect int) error {
+	code, msg, err := c.StreamResponse()
+	if err == nil && code != expect {
+		err = &NNTPError{code, msg}
+	}
+	return err
+}
+
+func (c *Client) writeArticle(a *Article) error {
+	dw := c.DotWriter()
+	if _, err := writeHeader(dw, a.Header, a.RawHeader); err != nil {
+		return err
+	}
+	if _, err := dw.Write(crlf); err != nil {
+		return err
+	}
+	if a.Body != nil {
+		if _, err := io.Copy(dw, a.Body); err != nil {
+			return err
+		}
+	}
+	return dw.Close()
+}
+
+// Group selects a newsgroup and returns its estimated article count and
+// low and high water marks.
+func (c *Client) Group(name string) (count, low, high int64, err error) {
+	_, msg, err := c.Cmd(211, "GROUP %s", name)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if _, err := fmt.Sscanf(msg, "%d %d %d", &count, &low, &high); err != nil {
+		return 0, 0, 0, fmt.Errorf("bad GROUP response %q", msg)
+	}
+	return count, low, high, nil
+}
+
+// List sends LIST with the given keyword and arguments (e.g. "ACTIVE")
+// and returns the lines of the response.
+func (c *Client) List(keyword string) ([]string, error) {
+	if _, _, err := c.Cmd(215, "LIST %s", keyword); err != nil {
+		return nil, err
+	}
+	return c.ReadDotLines()
+}
+
+// Over returns the overview lines of articles from to to in the current
+// group. Fields are tab separated, the first one is the article number.
+func (c *Client) Over(from, to int64) ([]string, error) {
+	if _, _, err := c.Cmd(224, "OVER %d-%d", from, to); err != nil {
+		return nil, err
+	}
+	return c.ReadDotLines()
+}
+
+// Article fetches an article by number or message-id.
+func (c *Client) Article(id string) (*Article, error) {
+	if _, _, err := c.Cmd(220, "ARTICLE %s", id); err != nil {
+		return nil, err
+	}
+	return readArticle(c.Conn, 0)
+}
+
+// Quit sends QUIT and closes the connection.
+func (c *Client) Quit() error {
+	c.Cmd(205, "QUIT")
+	return c.Close()
+}
@@ -1,5 +1,8 @@
 module github.com/coyove/enn
 
-go 1.13
+go 1.15
 
-require github.com/coyove/common v0.0.0-20200714073322-5d32ad16e471
+require (
+	github.com/coyove/common v0.0.0-20200714073322-5d32ad16e471
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+)
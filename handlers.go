@@ -47,17 +47,29 @@ func handleOver(args []string, s *session, c *textproto.Conn) error {
 	dw := c.DotWriter()
 	defer dw.Close()
 	for _, a := range articles {
-		fmt.Fprintf(dw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", a.Num,
-			a.Article.Header.Get("Subject"),
-			a.Article.Header.Get("From"),
-			a.Article.Header.Get("Date"),
-			a.Article.Header.Get("Message-Id"),
-			a.Article.Header.Get("References"),
+		fmt.Fprintf(dw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\r\n", a.Num,
+			overField(a.Article.Header.Get("Subject")),
+			overField(a.Article.Header.Get("From")),
+			overField(a.Article.Header.Get("Date")),
+			overField(a.Article.Header.Get("Message-Id")),
+			overField(a.Article.Header.Get("References")),
 			a.Article.Bytes, a.Article.Lines)
 	}
 	return nil
 }
 
+// overField replaces TAB, CR and LF in a header value with spaces, as
+// required for overview fields by RFC 3977 section 8.3.
+func overField(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\t', '\r', '\n':
+			return ' '
+		}
+		return r
+	}, v)
+}
+
 func handleListOverviewFmt(c *textproto.Conn) error {
 	err := c.PrintfLine("215 Order of fields in overview database.")
 	if err != nil {
@@ -65,13 +77,7 @@ func handleListOverviewFmt(c *textproto.Conn) error {
 	}
 	dw := c.DotWriter()
 	defer dw.Close()
-	_, err = fmt.Fprintln(dw, `Subject:
-From:
-Date:
-Message-ID:
-References:
-:bytes
-:lines`)
+	_, err = fmt.Fprint(dw, "Subject:\r\nFrom:\r\nDate:\r\nMessage-ID:\r\nReferences:\r\n:bytes\r\n:lines\r\n")
 	return err
 }
 
@@ -134,7 +140,7 @@ func handleGroup(args []string, s *session, c *textproto.Conn) error {
 		return err
 	}
 
-	s.group = group
+	s.setGroup(group)
 
 	c.PrintfLine("211 %d %d %d %s", group.Count, group.Low, group.High, group.Name)
 	return nil
@@ -177,10 +183,8 @@ func handleHead(args []string, s *session, c *textproto.Conn) error {
 	c.PrintfLine("221 1 %s", article.MessageID())
 	dw := c.DotWriter()
 	defer dw.Close()
-	for k, v := range article.Header {
-		fmt.Fprintf(dw, "%s: %s\r\n", k, v[0])
-	}
-	return nil
+	_, err = writeHeader(dw, article.Header, article.RawHeader)
+	return err
 }
 
 /*
@@ -260,11 +264,12 @@ func handleArticle(args []string, s *session, c *textproto.Conn) error {
 	dw := c.DotWriter()
 	defer dw.Close()
 
-	for k, v := range article.Header {
-		fmt.Fprintf(dw, "%s: %s\r\n", k, v[0])
+	if _, err := writeHeader(dw, article.Header, article.RawHeader); err != nil {
+		return err
+	}
+	if _, err := dw.Write(crlf); err != nil {
+		return err
 	}
-
-	fmt.Fprintln(dw, "")
 
 	_, err = io.Copy(dw, article.Body)
 	return err
@@ -290,16 +295,20 @@ func handlePost(args []string, s *session, c *textproto.Conn) error {
 		return ErrPostingNotPermitted
 	}
 
-	c.PrintfLine("340 Input article; end with <CR-LF>.<CR-LF>")
-	var err error
-	var article Article
-	article.Header, err = c.ReadMIMEHeader()
+	if s.server.MaxArticleSize > 0 {
+		c.PrintfLine("340 Input article; end with <CR-LF>.<CR-LF> (max %d bytes)", s.server.MaxArticleSize)
+	} else {
+		c.PrintfLine("340 Input article; end with <CR-LF>.<CR-LF>")
+	}
+	article, err := readArticle(c, s.server.MaxArticleSize)
 	if err != nil {
+		if _, ok := err.(*NNTPError); ok {
+			return err
+		}
 		return ErrPostingFailed
 	}
-	article.Body = c.DotReader()
 	article.RemoteAddr = s.conn.RemoteAddr()
-	err = s.backend.Post(&article)
+	err = s.backend.Post(article)
 	if err != nil {
 		return err
 	}
@@ -307,10 +316,28 @@ func handlePost(args []string, s *session, c *textproto.Conn) error {
 	return nil
 }
 
+// allowTransfer reports whether the session may send IHAVE, CHECK and
+// TAKETHIS.
+func (s *session) allowTransfer() bool {
+	if !s.backend.AllowPost() {
+		return false
+	}
+	if pb, ok := s.backend.(PeerBackend); ok {
+		return pb.AllowTransfer()
+	}
+	return true
+}
+
 func handleIHave(args []string, s *session, c *textproto.Conn) error {
 	if !s.backend.AllowPost() {
 		return ErrNotWanted
 	}
+	if !s.allowTransfer() {
+		return ErrTransferRejected
+	}
+	if len(args) != 1 {
+		return ErrSyntax
+	}
 
 	// XXX:  See if we have it.
 	article, err := s.backend.GetArticle(nil, args[0], true)
@@ -319,38 +346,127 @@ func handleIHave(args []string, s *session, c *textproto.Conn) error {
 	}
 
 	c.PrintfLine("335 send it")
-	article = &Article{}
-	article.Header, err = c.ReadMIMEHeader()
+	article, err = readArticle(c, s.server.MaxArticleSize)
 	if err != nil {
-		return ErrPostingFailed
+		if e, ok := err.(*NNTPError); ok {
+			return transferError(e)
+		}
+		return ErrTransferFailed
 	}
-	article.Body = c.DotReader()
+	article.RemoteAddr = s.conn.RemoteAddr()
+	article.Transfer = true
 	err = s.backend.Post(article)
 	if err != nil {
-		return err
+		if e, ok := err.(*NNTPError); ok {
+			return transferError(e)
+		}
+		s.log.Error("transfer failed", "err", err)
+		return ErrTransferFailed
 	}
 	c.PrintfLine("235 article received OK")
 	return nil
 }
 
+/*
+   Syntax
+     CHECK message-id
+
+   Responses
+     238 message-id   Send article to be transferred
+     431 message-id   Transfer not possible; try again later
+     438 message-id   Article not wanted
+*/
+
+func handleCheck(args []string, s *session, c *textproto.Conn) error {
+	if len(args) != 1 {
+		return ErrSyntax
+	}
+	if !s.allowTransfer() {
+		return c.PrintfLine("438 %s", args[0])
+	}
+	if article, _ := s.backend.GetArticle(nil, args[0], true); article != nil {
+		return c.PrintfLine("438 %s", args[0])
+	}
+	return c.PrintfLine("238 %s", args[0])
+}
+
+/*
+   Syntax
+     TAKETHIS message-id
+
+   Responses
+     239 message-id   Article transferred OK
+     439 message-id   Transfer rejected; do not retry
+*/
+
+func handleTakeThis(args []string, s *session, c *textproto.Conn) error {
+	if len(args) != 1 {
+		return ErrSyntax
+	}
+
+	// The article follows the command immediately and has to be read in any case
+	article, err := readArticle(c, s.server.MaxArticleSize)
+	if err != nil {
+		if _, ok := err.(*NNTPError); !ok {
+			return err
+		}
+		return c.PrintfLine("439 %s", args[0])
+	}
+	if !s.allowTransfer() {
+		return c.PrintfLine("439 %s", args[0])
+	}
+	if a, _ := s.backend.GetArticle(nil, args[0], true); a != nil {
+		return c.PrintfLine("439 %s", args[0])
+	}
+
+	article.RemoteAddr = s.conn.RemoteAddr()
+	article.Transfer = true
+	if err := s.backend.Post(article); err != nil {
+		if _, ok := err.(*NNTPError); !ok {
+			return err
+		}
+		return c.PrintfLine("439 %s", args[0])
+	}
+	return c.PrintfLine("239 %s", args[0])
+}
+
+// transferError maps a posting error to its IHAVE counterpart: a
+// rejected posting is a rejected transfer (437). Backends report failures
+// worth retrying, like a cooldown, as 436 which is passed through.
+func transferError(e *NNTPError) error {
+	if e.Code == ErrPostingFailed.Code {
+		return &NNTPError{ErrTransferRejected.Code, e.Msg}
+	}
+	return e
+}
+
 func handleCap(args []string, s *session, c *textproto.Conn) error {
 	c.PrintfLine("101 Capability list:")
 	dw := c.DotWriter()
 	defer dw.Close()
 
-	fmt.Fprintf(dw, "VERSION 2\n")
-	fmt.Fprintf(dw, "READER\n")
+	fmt.Fprintf(dw, "VERSION 2\r\n")
+	fmt.Fprintf(dw, "READER\r\n")
 	if s.backend.AllowPost() {
-		fmt.Fprintf(dw, "POST\n")
-		fmt.Fprintf(dw, "IHAVE\n")
+		fmt.Fprintf(dw, "POST\r\n")
+	}
+	if s.allowTransfer() {
+		fmt.Fprintf(dw, "IHAVE\r\n")
+		fmt.Fprintf(dw, "STREAMING\r\n")
 	}
-	fmt.Fprintf(dw, "OVER\n")
-	fmt.Fprintf(dw, "XOVER\n")
-	fmt.Fprintf(dw, "LIST ACTIVE NEWSGROUPS OVERVIEW.FMT\n")
+	fmt.Fprintf(dw, "OVER\r\n")
+	fmt.Fprintf(dw, "XOVER\r\n")
+	fmt.Fprintf(dw, "LIST ACTIVE NEWSGROUPS OVERVIEW.FMT\r\n")
 	return nil
 }
 
 func handleMode(args []string, s *session, c *textproto.Conn) error {
+	if len(args) > 0 && strings.ToLower(args[0]) == "stream" {
+		if !s.backend.AllowPost() {
+			return ErrPostingNotPermitted
+		}
+		return c.PrintfLine("203 Streaming permitted")
+	}
 	if s.backend.AllowPost() {
 		c.PrintfLine("200 Posting allowed")
 	} else {
@@ -367,9 +483,10 @@ func handleAuthInfo(args []string, s *session, c *textproto.Conn) error {
 		return ErrSyntax
 	}
 
-	// if s.backend.Authorized() {
-	// 	return c.PrintfLine("281 Authentication accepted")
-	// }
+	// RFC 4643 section 2.2, also after a client certificate login
+	if s.userName() != "" {
+		return &NNTPError{502, "Already authenticated"}
+	}
 
 	c.PrintfLine("381 Password required")
 
@@ -380,6 +497,11 @@ func handleAuthInfo(args []string, s *session, c *textproto.Conn) error {
 	}
 	b, err := s.backend.Authenticate(args[1], parts[2])
 	if err == nil {
+		if err := s.server.admitUser(s, args[1]); err != nil {
+			s.log.Info("refused", "user", args[1], "err", err)
+			c.PrintfLine(err.Error())
+			return io.EOF
+		}
 		c.PrintfLine("281 Authentication accepted")
 		if b != nil {
 			s.backend = b
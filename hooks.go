@@ -0,0 +1,77 @@
+package enn
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Hooks let embedders observe a Server, e.g. to export metrics. Any of
+// them may be nil. They are called from session goroutines and must be
+// safe for concurrent use.
+type Hooks struct {
+	SessionStart func(remote net.Addr)
+	SessionEnd   func(remote net.Addr)
+	// Command is called once a command has been answered.
+	Command func(ev *CommandEvent)
+	// ThrotWait is called when a session is slowed down by the command
+	// throttle.
+	ThrotWait func(wait time.Duration)
+}
+
+// A CommandEvent describes a handled command.
+type CommandEvent struct {
+	// Name is the lower case command name, "unknown" for commands
+	// without a handler.
+	Name string
+	// Code is the final status code of the response, e.g. 240 rather than
+	// 340 for POST, 0 if none was sent.
+	Code     int
+	Duration time.Duration
+	// BytesIn and BytesOut count the octets read and written since the
+	// previous command was answered, this command's line included.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// countConn counts the octets going through a connection and records the
+// status code starting the first write after reset or after reading from
+// the client, which is the final response of multi-stage commands.
+type countConn struct {
+	net.Conn
+	in, out int64
+	code    int32
+	sniff   int32
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.in, int64(n))
+	if n > 0 {
+		atomic.StoreInt32(&c.sniff, 1)
+	}
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	if len(p) >= 3 && atomic.CompareAndSwapInt32(&c.sniff, 1, 0) {
+		code := 0
+		for _, b := range p[:3] {
+			if b < '0' || b > '9' {
+				code = 0
+				break
+			}
+			code = code*10 + int(b-'0')
+		}
+		atomic.StoreInt32(&c.code, int32(code))
+	}
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.out, int64(n))
+	return n, err
+}
+
+// reset starts watching for the response of a new command.
+func (c *countConn) reset() {
+	atomic.StoreInt32(&c.code, 0)
+	atomic.StoreInt32(&c.sniff, 1)
+}
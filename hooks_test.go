@@ -0,0 +1,37 @@
+package enn
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestCountConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go ioutil.ReadAll(b)
+
+	c := &countConn{Conn: a}
+	c.reset()
+	c.Write([]byte("211 1 1 1 a.b\r\n"))
+	c.Write([]byte("500 not a status line\r\n"))
+	if c.code != 211 || c.out != 38 {
+		t.Fatalf("code %d, out %d", c.code, c.out)
+	}
+
+	c.reset()
+	c.Write([]byte(".\r\n"))
+	if c.code != 0 {
+		t.Fatalf("code %d", c.code)
+	}
+
+	// The client sends the article, the second response is the final one
+	c.reset()
+	c.Write([]byte("340 send article\r\n"))
+	go b.Write([]byte("article\r\n.\r\n"))
+	c.Read(make([]byte, 64))
+	c.Write([]byte("240 article received\r\n"))
+	if c.code != 240 {
+		t.Fatalf("code %d", c.code)
+	}
+}
@@ -0,0 +1,217 @@
+package enn
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateFormat is the RFC 5322 date-time format used for Date and Injection-Date.
+const DateFormat = "Mon, 02 Jan 2006 15:04:05 -0700"
+
+// Headers that must not appear more than once in an article (RFC 5536
+// section 3 and RFC 5322 section 3.6).
+var singleHeaders = []string{
+	"Date", "From", "Sender", "Reply-To", "Message-Id", "Subject",
+	"Newsgroups", "Path", "References", "Followup-To", "Expires",
+	"Control", "Supersedes", "Approved", "Distribution", "Organization",
+}
+
+// An Injector is the injecting agent of RFC 5537 section 3.5. It checks
+// that an article received from a posting client is well formed and adds
+// the headers recording its injection, so every backend sees articles in
+// the same shape.
+type Injector struct {
+	// ServerName is the path identity of this server, used in Path,
+	// Message-ID and Injection-Info.
+	ServerName string
+}
+
+func injectError(f string, a ...interface{}) error {
+	return &NNTPError{ErrPostingFailed.Code, fmt.Sprintf(f, a...)}
+}
+
+// Inject validates a posted article and fills in Date, Message-ID, Path,
+// Injection-Date and Injection-Info. Malformed articles are rejected with
+// a 441 NNTPError naming the problem. Xref is left to the backend, which
+// is the only one knowing the article numbers.
+func (in *Injector) Inject(a *Article) error {
+	h := a.Header
+
+	if len(h["Injection-Info"]) > 0 {
+		return injectError("Article already injected, use IHAVE")
+	}
+	if err := validate(h, "From", "Newsgroups", "Subject"); err != nil {
+		return err
+	}
+
+	if h.Get("Message-Id") == "" {
+		h.Set("Message-Id", "<"+strconv.FormatInt(time.Now().Unix(), 36)+
+			strconv.FormatUint(uint64(rand.Uint32()), 36)+"@"+in.ServerName+">")
+	}
+
+	now := time.Now()
+	if h.Get("Date") == "" {
+		h.Set("Date", now.Format(DateFormat))
+	}
+
+	// The posting agent may supply a Path, it is kept after our identity
+	path := "not-for-mail"
+	if v := strings.TrimSpace(h.Get("Path")); v != "" {
+		path = v
+	}
+	h.Set("Path", in.ServerName+"!.POSTED!"+path)
+
+	info := in.ServerName
+	if addr, ok := a.RemoteAddr.(*net.TCPAddr); ok {
+		info += fmt.Sprintf("; posting-host=%q", addr.IP.String())
+	}
+	h.Set("Injection-Date", now.Format(DateFormat))
+	h.Set("Injection-Info", info)
+	h.Del("Xref")
+	return nil
+}
+
+// Relay validates an article transferred by a peer (IHAVE or TAKETHIS).
+// It must already be injected, so Message-ID, Date and Path are mandatory.
+// Articles which have been here before are refused, others get ServerName
+// prepended to Path (RFC 5537 section 3.2.1). Xref from the peer is dropped.
+func (in *Injector) Relay(a *Article) error {
+	if err := validate(a.Header, "From", "Newsgroups", "Subject", "Message-Id", "Date", "Path"); err != nil {
+		return err
+	}
+	path := strings.TrimSpace(a.Header.Get("Path"))
+	if PathContains(path, in.ServerName) {
+		return injectError("Path loop, already seen by %s", in.ServerName)
+	}
+	a.Header.Set("Path", in.ServerName+"!"+path)
+	a.Header.Del("Xref")
+	return nil
+}
+
+// validate checks the headers of an article against RFC 5536 and
+// normalizes Newsgroups to "a,b,...".
+func validate(h textproto.MIMEHeader, mandatory ...string) error {
+	for _, k := range mandatory {
+		if strings.TrimSpace(h.Get(k)) == "" {
+			return injectError("Missing %s header", k)
+		}
+	}
+	for _, k := range singleHeaders {
+		if len(h[k]) > 1 {
+			return injectError("Duplicate %s header", k)
+		}
+	}
+
+	if _, err := mail.ParseAddressList(h.Get("From")); err != nil {
+		return injectError("Invalid From header: %v", err)
+	}
+	if v := h.Get("Sender"); v != "" {
+		if _, err := mail.ParseAddress(v); err != nil {
+			return injectError("Invalid Sender header: %v", err)
+		}
+	}
+
+	groups, err := ParseNewsgroups(h.Get("Newsgroups"))
+	if err != nil {
+		return err
+	}
+	h.Set("Newsgroups", strings.Join(groups, ","))
+
+	if v := h.Get("Followup-To"); v != "" && strings.TrimSpace(v) != "poster" {
+		if _, err := ParseNewsgroups(v); err != nil {
+			return injectError("Invalid Followup-To header")
+		}
+	}
+
+	if v := h.Get("Message-Id"); v != "" {
+		if !ValidMessageID(strings.TrimSpace(v)) {
+			return injectError("Invalid Message-ID header")
+		}
+		h.Set("Message-Id", strings.TrimSpace(v))
+	}
+
+	for _, k := range []string{"References", "Supersedes"} {
+		for _, id := range strings.Fields(h.Get(k)) {
+			if !ValidMessageID(id) {
+				return injectError("Invalid %s header", k)
+			}
+		}
+	}
+
+	if v := h.Get("Date"); v != "" {
+		if _, err := mail.ParseDate(v); err != nil {
+			return injectError("Invalid Date header")
+		}
+	}
+	return nil
+}
+
+// PathContains reports whether the path identity id appears in a Path
+// header value, meaning the article has already been through that server.
+func PathContains(path, id string) bool {
+	for _, p := range strings.Split(path, "!") {
+		if strings.EqualFold(strings.TrimSpace(p), id) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNewsgroups splits a Newsgroups header into group names and checks
+// each one against the newsgroup-name syntax of RFC 5536 section 3.1.4.
+func ParseNewsgroups(v string) ([]string, error) {
+	var groups []string
+	for _, g := range strings.Split(v, ",") {
+		g = strings.TrimSpace(g)
+		if !ValidGroupName(g) {
+			return nil, injectError("Invalid newsgroup name %q", g)
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// ValidGroupName reports whether name is a valid newsgroup name.
+func ValidGroupName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, comp := range strings.Split(name, ".") {
+		if comp == "" {
+			return false
+		}
+		for _, c := range comp {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			case c == '+', c == '-', c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ValidMessageID reports whether id has the form <left@right> required by
+// RFC 5536 section 3.1.3.
+func ValidMessageID(id string) bool {
+	if len(id) < 5 || len(id) > 250 || id[0] != '<' || id[len(id)-1] != '>' {
+		return false
+	}
+	at := strings.Index(id, "@")
+	if at < 2 || at > len(id)-3 || strings.Count(id, "@") != 1 {
+		return false
+	}
+	for i := 1; i < len(id)-1; i++ {
+		if c := id[i]; c <= ' ' || c >= 0x7f || c == '<' || c == '>' {
+			return false
+		}
+	}
+	return true
+}
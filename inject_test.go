@@ -0,0 +1,92 @@
+package enn
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func testArticle(kv ...string) *Article {
+	h := textproto.MIMEHeader{}
+	for i := 0; i < len(kv); i += 2 {
+		h.Add(kv[i], kv[i+1])
+	}
+	return &Article{Header: h, RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}}
+}
+
+func TestInject(t *testing.T) {
+	in := &Injector{ServerName: "news.example"}
+
+	a := testArticle("From", "Joe <joe@example.com>", "Newsgroups", "a.b, c.d", "Subject", "hi", "Xref", "x a.b:1")
+	if err := in.Inject(a); err != nil {
+		t.Fatal(err)
+	}
+	h := a.Header
+	if h.Get("Newsgroups") != "a.b,c.d" {
+		t.Fatalf("Newsgroups not normalized: %q", h.Get("Newsgroups"))
+	}
+	if !ValidMessageID(h.Get("Message-Id")) || !strings.HasSuffix(h.Get("Message-Id"), "@news.example>") {
+		t.Fatalf("bad Message-ID: %q", h.Get("Message-Id"))
+	}
+	if h.Get("Path") != "news.example!.POSTED!not-for-mail" {
+		t.Fatalf("bad Path: %q", h.Get("Path"))
+	}
+	if h.Get("Injection-Info") != `news.example; posting-host="192.0.2.1"` {
+		t.Fatalf("bad Injection-Info: %q", h.Get("Injection-Info"))
+	}
+	if h.Get("Date") == "" || h.Get("Injection-Date") == "" || h.Get("Xref") != "" {
+		t.Fatalf("bad headers: %v", h)
+	}
+
+	// Injecting twice is refused
+	if err := in.Inject(a); err == nil {
+		t.Fatal("article injected twice")
+	}
+
+	bad := [][]string{
+		{"Newsgroups", "a.b", "Subject", "hi"},
+		{"From", "joe@example.com", "Subject", "hi"},
+		{"From", "joe@example.com", "Newsgroups", "a.b"},
+		{"From", "joe", "Newsgroups", "a.b", "Subject", "hi"},
+		{"From", "joe@example.com", "Newsgroups", "a..b", "Subject", "hi"},
+		{"From", "joe@example.com", "Newsgroups", "a.b", "Subject", "hi", "Subject", "again"},
+		{"From", "joe@example.com", "Newsgroups", "a.b", "Subject", "hi", "Message-Id", "<nope>"},
+		{"From", "joe@example.com", "Newsgroups", "a.b", "Subject", "hi", "References", "<a@b> c@d"},
+		{"From", "joe@example.com", "Newsgroups", "a.b", "Subject", "hi", "Date", "yesterday"},
+	}
+	for _, kv := range bad {
+		err := in.Inject(testArticle(kv...))
+		if e, ok := err.(*NNTPError); !ok || e.Code != 441 {
+			t.Fatalf("%v: got %v, wanted a 441 error", kv, err)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	in := &Injector{ServerName: "news.example"}
+
+	a := testArticle("From", "joe@example.com", "Newsgroups", "a.b", "Subject", "hi",
+		"Message-Id", "<1@peer.example>", "Date", "Mon, 02 Jan 2006 15:04:05 -0700",
+		"Path", "peer.example!.POSTED!not-for-mail", "Injection-Info", "peer.example", "Xref", "x a.b:1")
+	if err := in.Relay(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Header.Get("Path") != "news.example!peer.example!.POSTED!not-for-mail" || a.Header.Get("Xref") != "" {
+		t.Fatalf("bad headers: %v", a.Header)
+	}
+	if !PathContains(a.Header.Get("Path"), "PEER.example") || PathContains(a.Header.Get("Path"), "example") {
+		t.Fatal("PathContains")
+	}
+
+	// Coming back is a loop
+	if err := in.Relay(a); err == nil {
+		t.Fatal("relayed an article twice")
+	}
+
+	// Transferred articles must have been injected already
+	a = testArticle("From", "joe@example.com", "Newsgroups", "a.b", "Subject", "hi")
+	if err := in.Relay(a); err == nil {
+		t.Fatal("relayed an article without Message-ID")
+	}
+}
@@ -1,6 +1,8 @@
 package enn
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"math"
@@ -8,6 +10,8 @@ import (
 	"net/textproto"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coyove/enn/server/common"
@@ -42,6 +46,10 @@ type Group struct {
 type Article struct {
 	// The article's headers
 	Header textproto.MIMEHeader
+	// RawHeader is the header block as received, without the blank line.
+	// Headers Header still has unchanged are written back from it, keeping
+	// their order, case and folding.
+	RawHeader []byte
 	// The article's body
 	Body io.Reader
 	// Number of bytes in the article body (used by OVER/XOVER)
@@ -49,6 +57,9 @@ type Article struct {
 	// Number of lines in the article body (used by OVER/XOVER)
 	Lines      int
 	RemoteAddr net.Addr
+	// Transfer is set for articles received from peers by IHAVE or
+	// TAKETHIS, as opposed to articles posted by clients.
+	Transfer bool
 }
 
 // MessageID provides convenient access to the article's Message ID.
@@ -92,12 +103,22 @@ var ErrPostingNotPermitted = &NNTPError{440, "Posting not permitted"}
 // ErrPostingFailed is returned when an attempt to post an article fails.
 var ErrPostingFailed = &NNTPError{441, "posting failed"}
 
-var ErrPostingTooLarge = &NNTPError{441, "posting large article"}
+// ErrPostingTooLarge is returned when a posted article exceeds the
+// server's maximum article size.
+var ErrPostingTooLarge = &NNTPError{441, "Article too large"}
 
 // ErrNotWanted is returned when an attempt to post an article is
 // rejected due the server not wanting the article.
 var ErrNotWanted = &NNTPError{435, "Article not wanted"}
 
+// ErrTransferFailed is returned when a transferred article could not be
+// stored and may be offered again later.
+var ErrTransferFailed = &NNTPError{436, "Transfer failed, try again later"}
+
+// ErrTransferRejected is returned when a transferred article is rejected
+// and should not be offered again.
+var ErrTransferRejected = &NNTPError{437, "Transfer rejected, do not retry"}
+
 // ErrAuthRequired is returned to indicate authentication is required
 // to proceed.
 var ErrAuthRequired = &NNTPError{450, "authorization required"}
@@ -111,6 +132,9 @@ var ErrNotAuthenticated = &NNTPError{480, "authentication required"}
 
 var ErrServerBad = &NNTPError{500, "Server bad"}
 
+// ErrTooManyConns is the greeting of clients over the connection limit.
+var ErrTooManyConns = &NNTPError{400, "Too many connections"}
+
 var ErrNotMod = &NNTPError{Code: 441, Msg: "Not moderator"}
 
 // Handler is a low-level protocol handler
@@ -137,11 +161,47 @@ type Backend interface {
 	Post(article *Article) error
 }
 
+// A CertBackend authenticates sessions presenting a verified TLS client
+// certificate, returning the user name and the backend for the session.
+type CertBackend interface {
+	Backend
+	AuthenticateCert(cert *x509.Certificate) (string, Backend, error)
+}
+
+// A PeerBackend tells whether a session may transfer articles with IHAVE
+// and TAKETHIS, which skip injection. Backends without it take transfers
+// from every session allowed to post.
+type PeerBackend interface {
+	Backend
+	AllowTransfer() bool
+}
+
+// A SessionBackend gets the remote address and the logger of each session,
+// so it can tell clients apart and lines logged while serving that session
+// carry its fields.
+type SessionBackend interface {
+	Backend
+	ForSession(remote net.Addr, l *common.Logger) Backend
+}
+
 type session struct {
 	server  *Server
 	backend Backend
 	group   *Group
 	conn    net.Conn
+	log     *common.Logger
+
+	// Registry fields, read by other goroutines
+	id        int64
+	start     time.Time
+	cc        *countConn
+	commands  int64
+	mu        sync.Mutex
+	user      string
+	groupName string
+	lastCmd   string
+	ipKey     string
+	exempt    bool
 
 	throtTimer time.Time
 }
@@ -157,6 +217,28 @@ type Server struct {
 
 	ThrotCmdInterval time.Duration
 	ThrotCmdWindow   time.Duration
+
+	// MaxArticleSize limits the size of articles received by POST and
+	// IHAVE, headers included, in wire octets. Zero means no limit.
+	MaxArticleSize int64
+
+	// Connection limits, zero means no limit. IPv6 clients are counted by
+	// their /64. Clients over a limit are greeted with 400 and disconnected.
+	MaxConns        int
+	MaxConnsPerIP   int
+	MaxConnsPerUser int
+	// LimitExempt, when set, exempts clients from the connection limits.
+	LimitExempt func(net.IP) bool
+
+	// Log is the parent of session loggers, which add the session id and
+	// the remote address.
+	Log *common.Logger
+
+	Hooks Hooks
+
+	sessionID int64
+	mu        sync.Mutex
+	sessions  map[int64]*session
 }
 
 // NewServer builds a new server handle request to a backend.
@@ -166,6 +248,7 @@ func NewServer(backend Backend) *Server {
 		Backend:          backend,
 		ThrotCmdInterval: time.Second,
 		ThrotCmdWindow:   time.Second * 5,
+		Log:              common.Log,
 	}
 	rv.Handlers["quit"] = handleQuit
 	rv.Handlers["date"] = handleDate
@@ -176,6 +259,8 @@ func NewServer(backend Backend) *Server {
 	rv.Handlers["article"] = handleArticle
 	rv.Handlers["post"] = handlePost
 	rv.Handlers["ihave"] = handleIHave
+	rv.Handlers["check"] = handleCheck
+	rv.Handlers["takethis"] = handleTakeThis
 	rv.Handlers["capabilities"] = handleCap
 	rv.Handlers["mode"] = handleMode
 	rv.Handlers["authinfo"] = handleAuthInfo
@@ -195,7 +280,7 @@ func (s *session) dispatchCommand(cmd string, args []string, c *textproto.Conn)
 
 	handler, found := s.server.Handlers[cmd]
 	if !found {
-		common.E("unknown command: %v %v", cmd, args)
+		s.log.Info("unknown command", "cmd", cmd)
 		handler = handleDefault
 	}
 	return handler(args, s, c)
@@ -203,34 +288,74 @@ func (s *session) dispatchCommand(cmd string, args []string, c *textproto.Conn)
 
 // Process an NNTP session.
 func (s *Server) Process(nc net.Conn) {
-	defer func() {
-		if r := recover(); r != nil {
-			common.E("panic: %v: %v", nc.RemoteAddr(), r)
-		}
-		nc.Close()
-	}()
-
-	c := textproto.NewConn(nc)
+	cc := &countConn{Conn: nc}
+	c := textproto.NewConn(cc)
 
 	sess := &session{
 		server:     s,
 		backend:    s.Backend,
 		group:      nil,
 		conn:       nc,
+		id:         atomic.AddInt64(&s.sessionID, 1),
+		start:      time.Now(),
+		cc:         cc,
 		throtTimer: time.Now(),
 	}
+	sess.log = s.Log.With("session", sess.id, "remote", nc.RemoteAddr())
+	defer func() {
+		if r := recover(); r != nil {
+			sess.log.Error("panic", "err", fmt.Sprint(r))
+		}
+		nc.Close()
+	}()
+
+	if sb, ok := s.Backend.(SessionBackend); ok {
+		sess.backend = sb.ForSession(nc.RemoteAddr(), sess.log)
+	}
+
+	if err := s.admit(sess); err != nil {
+		sess.log.Info("refused", "err", err)
+		c.PrintfLine(err.Error())
+		return
+	}
+	defer s.unregister(sess)
+
+	if tc, ok := nc.(*tls.Conn); ok {
+		if err := sess.authenticateCert(tc); err != nil {
+			sess.log.Info("refused", "err", err)
+			if _, ok := err.(*NNTPError); ok {
+				c.PrintfLine(err.Error())
+			}
+			return
+		}
+	}
+
+	if s.Hooks.SessionStart != nil {
+		s.Hooks.SessionStart(nc.RemoteAddr())
+	}
+	defer func() {
+		if s.Hooks.SessionEnd != nil {
+			s.Hooks.SessionEnd(nc.RemoteAddr())
+		}
+	}()
+
+	var lastIn, lastOut int64
 
 	c.PrintfLine("200 Hello!")
 	for {
 		l, err := c.ReadLine()
 		if err != nil {
 			if err != io.EOF {
-				common.E("client.ReadLine: %v: %v", nc.RemoteAddr(), err)
+				sess.log.Error("read command", "err", err)
 			}
 			return
 		}
 		cmd := strings.Split(l, " ")
-		common.L("%v", cmd)
+		if strings.EqualFold(cmd[0], "authinfo") && len(cmd) > 2 {
+			l = cmd[0] + " " + cmd[1] + " ***"
+		}
+		sess.log.Debug("command", "cmd", l)
+		sess.setCommand(l)
 
 		args := []string{}
 		if len(cmd) > 1 {
@@ -245,21 +370,43 @@ func (s *Server) Process(nc net.Conn) {
 		} else {
 			wait := sess.throtTimer.Add(-s.ThrotCmdWindow).Sub(now)
 			if wait > time.Millisecond*250 {
-				common.D("%v: throt wait %v", nc.RemoteAddr(), wait)
+				sess.log.Debug("throt wait", "wait", wait)
+				if s.Hooks.ThrotWait != nil {
+					s.Hooks.ThrotWait(wait)
+				}
 				time.Sleep(wait)
 			}
 		}
 
-		if err := sess.dispatchCommand(cmd[0], args, c); err != nil {
-			switch _, isNNTPError := err.(*NNTPError); {
-			case err == io.EOF:
-				return
-			case isNNTPError:
-				c.PrintfLine(err.Error())
-			default:
-				common.E("%q at %v: %v", cmd, nc.RemoteAddr(), err)
-				return
+		start := time.Now()
+		cc.reset()
+		err = sess.dispatchCommand(cmd[0], args, c)
+		_, isNNTPError := err.(*NNTPError)
+		if isNNTPError {
+			c.PrintfLine(err.Error())
+		}
+
+		if s.Hooks.Command != nil {
+			ev := &CommandEvent{
+				Name:     strings.ToLower(cmd[0]),
+				Code:     int(atomic.LoadInt32(&cc.code)),
+				Duration: time.Since(start),
+			}
+			if _, ok := s.Handlers[ev.Name]; !ok {
+				ev.Name = "unknown"
 			}
+			in, out := atomic.LoadInt64(&cc.in), atomic.LoadInt64(&cc.out)
+			ev.BytesIn, ev.BytesOut = in-lastIn, out-lastOut
+			lastIn, lastOut = in, out
+			s.Hooks.Command(ev)
+		}
+
+		switch {
+		case err == io.EOF:
+			return
+		case err != nil && !isNNTPError:
+			sess.log.Error("command failed", "cmd", cmd[0], "err", err)
+			return
 		}
 	}
 }
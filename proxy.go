@@ -0,0 +1,167 @@
+package enn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyHeaderTimeout bounds the time a proxy has to send its header.
+const ProxyHeaderTimeout = 10 * time.Second
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A ProxyListener accepts connections relayed by proxies speaking the PROXY
+// protocol (v1 or v2, as sent by HAProxy), so RemoteAddr of the accepted
+// connections is the one of the real client. Only connections coming from
+// an address for which Trusted returns true are expected to carry the header,
+// others are passed through as they are.
+//
+// The header is read on the first call to Read or RemoteAddr of a connection,
+// not by Accept, so a slow proxy does not hold up the accept loop.
+type ProxyListener struct {
+	net.Listener
+	Trusted func(net.IP) bool
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tcpaddr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || l.Trusted == nil || !l.Trusted(tcpaddr.IP) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address sent by the proxy, or the one of
+// the proxy itself for health checks (LOCAL, UNKNOWN) and bad headers.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func proxyError(f string) error {
+	return errors.New("proxy protocol: " + f)
+}
+
+// readProxyHeader reads a PROXY protocol header and returns the source
+// address it carries, nil when there is none.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Peek no further than a header can match, clients may send less
+	for i := 1; i <= len(proxyV2Sig); i++ {
+		buf, err := r.Peek(i)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case bytes.Equal(buf, proxyV2Sig):
+			return readProxyV2(r)
+		case bytes.Equal(buf, []byte("PROXY ")):
+			return readProxyV1(r)
+		case !bytes.HasPrefix(proxyV2Sig, buf) && !bytes.HasPrefix([]byte("PROXY "), buf):
+			return nil, proxyError("missing header")
+		}
+	}
+	return nil, proxyError("missing header")
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest v1 header is 107 octets
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if line = append(line, b); b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, proxyError("v1 header too long")
+	}
+
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, proxyError("bad v1 header")
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil || (f[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, proxyError("bad v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, proxyError("bad v2 version")
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]&0xf == 0 {
+		// LOCAL, sent by the proxy itself
+		return nil, nil
+	}
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(buf) < 12 {
+			return nil, proxyError("short v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(buf[:4]), Port: int(binary.BigEndian.Uint16(buf[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(buf) < 36 {
+			return nil, proxyError("short v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(buf[:16]), Port: int(binary.BigEndian.Uint16(buf[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,74 @@
+package enn
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addr ...byte) string {
+		return string(proxyV2Sig) + string([]byte{cmd, fam, 0, byte(len(addr))}) + string(addr)
+	}
+	for hdr, want := range map[string]string{
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1234 119\r\n":              "1.2.3.4:1234",
+		"PROXY TCP6 2001:db8::1 ::1 1234 119\r\n":              "[2001:db8::1]:1234",
+		"PROXY UNKNOWN\r\n":                                    "",
+		"PROXY TCP4 2001:db8::1 ::1 1234 119\r\n":              "error",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 123456 119\r\n":            "error",
+		"PROXY TCP4 " + strings.Repeat("1", 100):               "error",
+		"GROUP a.b\r\n":                                        "error",
+		v2(0x21, 0x11, 1, 2, 3, 4, 5, 6, 7, 8, 4, 210, 0, 119): "1.2.3.4:1234",
+		v2(0x21, 0x21, 0x20, 1, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 4, 210, 0, 119): "[2001:db8::1]:1234",
+		v2(0x20, 0x00):          "",
+		v2(0x21, 0x11, 1, 2, 3): "error",
+		v2(0x11, 0x11):          "error",
+	} {
+		r := bufio.NewReader(strings.NewReader(hdr + "DATE\r\n"))
+		addr, err := readProxyHeader(r)
+		got := ""
+		if err != nil {
+			got = "error"
+		} else if addr != nil {
+			got = addr.String()
+		}
+		if got != want {
+			t.Fatalf("%q: %v %v", hdr, got, err)
+		}
+		if rest, _ := ioutil.ReadAll(r); err == nil && string(rest) != "DATE\r\n" {
+			t.Fatalf("%q: rest %q", hdr, rest)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pl := &ProxyListener{Listener: l, Trusted: func(ip net.IP) bool { return ip.IsLoopback() }}
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1234 119\r\nDATE\r\n"))
+		c.Close()
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := c.RemoteAddr().String(); addr != "1.2.3.4:1234" {
+		t.Fatal(addr)
+	}
+	if buf, _ := ioutil.ReadAll(c); string(buf) != "DATE\r\n" {
+		t.Fatalf("%q", buf)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/coyove/enn"
+	"github.com/coyove/enn/server/common"
+)
+
+// An acl is a comma separated list of user names, @roles and IPs/CIDRs, or *
+// for everyone. @user matches any logged in session, @mod mods and admins.
+// A nil acl, from an empty list, allows everyone.
+type acl struct {
+	users map[string]bool
+	roles map[string]bool
+	hosts []*net.IPNet
+}
+
+func parseACL(s string) *acl {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	a := &acl{users: map[string]bool{}, roles: map[string]bool{}}
+	for _, e := range strings.Split(s, ",") {
+		switch e = strings.TrimSpace(e); {
+		case e == "":
+		case e == "*":
+			return nil
+		case strings.HasPrefix(e, "@"):
+			a.roles[e[1:]] = true
+		case strings.Contains(e, "/") || net.ParseIP(e) != nil:
+			a.hosts = append(a.hosts, parseHosts(e)...)
+		default:
+			a.users[e] = true
+		}
+	}
+	return a
+}
+
+func (a *acl) allows(db *Backend) bool {
+	if a == nil || db.trusted {
+		return true
+	}
+	if db.remoteIP != nil && hostsContain(a.hosts, db.remoteIP) {
+		return true
+	}
+	role, ok := db.role()
+	if !ok {
+		return false
+	}
+	switch role {
+	case common.RoleAdmin:
+		return true
+	case common.RoleMod:
+		if a.roles[common.RoleMod] {
+			return true
+		}
+	}
+	return a.roles[common.RoleUser] || a.users[db.AuthObject.User]
+}
+
+// listsPeer reports whether a peer may be fed what the acl guards: roles
+// and hosts are for local sessions, so a restricted acl has to name it.
+func (a *acl) listsPeer(p *peer) bool {
+	return a == nil || a.users[p.Info.Name]
+}
+
+// groupACL controls who can see a group in lists, read and post to it.
+// List defaults to Read, so restricting Read makes a private group.
+type groupACL struct {
+	list, read, post *acl
+}
+
+func parseGroupACL(info *common.BaseGroupInfo) groupACL {
+	list := info.List
+	if list == "" {
+		list = info.Read
+	}
+	return groupACL{list: parseACL(list), read: parseACL(info.Read), post: parseACL(info.Post)}
+}
+
+// canReadArticle reports whether one of the groups of an article is
+// readable, or none of them exists anymore.
+func (db *Backend) canReadArticle(a *enn.Article) bool {
+	found := false
+	for _, name := range strings.Split(a.Header.Get("Newsgroups"), ",") {
+		if gs, ok := db.internalGetGroup(strings.TrimSpace(name)); ok {
+			if gs.acl.read.allows(db) {
+				return true
+			}
+			found = true
+		}
+	}
+	return !found
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coyove/enn"
+	"github.com/coyove/enn/server/common"
+)
+
+// AdminHandler serves the admin API, authenticated by the bearer token in
+// Config.AdminToken and disabled when it is empty:
+//
+//	GET  /admin/sessions          lists the connected sessions
+//	POST /admin/sessions/kill?id= disconnects a session
+func AdminHandler(s *enn.Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Sessions())
+	})
+	mux.HandleFunc("/admin/sessions/kill", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", 400)
+			return
+		}
+		if !s.Kill(id) {
+			http.Error(w, "no such session", 404)
+			return
+		}
+		common.Log.Info("admin: kill session", "session", id, "remote", r.RemoteAddr)
+		w.WriteHeader(204)
+	})
+
+	return adminOnly(mux)
+}
+
+// adminOnly lets through the requests bearing Config.AdminToken.
+func adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := db.Config.AdminToken
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
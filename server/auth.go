@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coyove/enn"
+)
+
+// accountAuth authenticates against the accounts of the index.
+type accountAuth struct{ db *Backend }
+
+func (a accountAuth) Authenticate(user, pass string) (*enn.Identity, error) {
+	return a.db.login(user, pass)
+}
+
+// newAuthenticator builds the comma separated authenticators of Config.Auth,
+// tried in order:
+//
+//	accounts          accounts of the index, managed by -user and -mod
+//	htpasswd:<file>   an htpasswd file, see enn.HtpasswdFile
+//	exec:<command>    a program, see enn.ExecAuthenticator
+//
+// An empty list means accounts.
+func (db *Backend) newAuthenticator(spec string) (enn.Authenticator, error) {
+	var chain enn.ChainAuthenticator
+	for _, p := range strings.Split(spec, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		kind, arg := p, ""
+		if idx := strings.Index(p, ":"); idx > -1 {
+			kind, arg = p[:idx], strings.TrimSpace(p[idx+1:])
+		}
+		switch kind {
+		case "accounts":
+			chain = append(chain, accountAuth{db})
+		case "htpasswd":
+			chain = append(chain, &enn.HtpasswdFile{Path: arg})
+		case "exec":
+			args := strings.Fields(arg)
+			if len(args) == 0 {
+				return nil, fmt.Errorf("auth %q: missing command", p)
+			}
+			chain = append(chain, &enn.ExecAuthenticator{Path: args[0], Args: args[1:]})
+		default:
+			return nil, fmt.Errorf("auth %q: unknown authenticator", p)
+		}
+	}
+	switch len(chain) {
+	case 0:
+		return accountAuth{db}, nil
+	case 1:
+		return chain[0], nil
+	}
+	return chain, nil
+}
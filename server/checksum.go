@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+
+	"github.com/coyove/enn/server/common"
+)
+
+const (
+	// Data records are sep, length (int64) and the article. Those written
+	// since checksums were added are sepCRC, CRC32C of the article (uint32),
+	// length and the article, the length stays 8 bytes before the article.
+	dataSep    = "\x01\x23\x45\x67\x89\xab\xcd\xef"
+	dataSepCRC = "\x01\x23\x45\x67\x89\xab\xcd\xee"
+	// Header sizes of both kinds of records
+	dataHeaderLen    = 20
+	oldDataHeaderLen = 16
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(buf []byte) uint32 { return crc32.Checksum(buf, castagnoli) }
+
+// dataHeader returns the header of a new data record holding buf.
+func dataHeader(buf []byte) []byte {
+	hdr := make([]byte, 0, dataHeaderLen)
+	hdr = append(hdr, dataSepCRC...)
+	hdr = append(hdr, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(hdr[8:], checksum(buf))
+	binary.BigEndian.PutUint64(hdr[12:], uint64(len(buf)))
+	return hdr
+}
+
+// readDataHeader checks the length marker of ar and returns the checksum
+// of the article, ok is false for records written without one.
+func readDataHeader(f io.ReaderAt, ar *common.ArticleRef) (sum uint32, ok bool, err error) {
+	var hdr [dataHeaderLen]byte
+	switch {
+	case ar.Offset >= dataHeaderLen:
+		_, err = f.ReadAt(hdr[:], ar.Offset-dataHeaderLen)
+	case ar.Offset >= 8:
+		_, err = f.ReadAt(hdr[12:], ar.Offset-8)
+	default:
+		err = fmt.Errorf("invalid offset %d", ar.Offset)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if n := int64(binary.BigEndian.Uint64(hdr[12:])); n != ar.Length {
+		return 0, false, fmt.Errorf("invalid length marker %d, expect %d", n, ar.Length)
+	}
+	// The 4 bytes before an old record are the start of dataSep, never dataSepCRC
+	if string(hdr[:8]) == dataSepCRC {
+		return binary.BigEndian.Uint32(hdr[8:]), true, nil
+	}
+	return 0, false, nil
+}
+
+// sumLines appends "\t<CRC32C in hex>" to every line of buf.
+func sumLines(buf []byte) []byte {
+	lines := bytes.Split(buf, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) > 0 {
+			lines[i] = append(line, fmt.Sprintf("\t%08x", checksum(line))...)
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// checkLine strips the checksum of an index line, ok is false when it
+// does not match. Lines written before checksums were added have none,
+// summed reports whether there was one.
+func checkLine(line []byte) (rest []byte, summed, ok bool) {
+	i := len(line) - 9
+	if i < 0 || line[i] != '\t' {
+		return line, false, true
+	}
+	sum, err := strconv.ParseUint(string(line[i+1:]), 16, 32)
+	return line[:i], true, err == nil && uint32(sum) == checksum(line[:i])
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -13,11 +16,13 @@ import (
 	"github.com/coyove/enn/server/common"
 )
 
+var stdin = bufio.NewReader(os.Stdin)
+
 func askInput(prompt, value interface{}) (string, int64) {
-	var in string
 	fmt.Printf("%s (default: %#v) >> ", prompt, value)
-	fmt.Scanln(&in)
-	if in == "" {
+	// Whole lines, values like From may contain spaces
+	in, _ := stdin.ReadString('\n')
+	if in = strings.TrimSpace(in); in == "" {
 		in = fmt.Sprint(value)
 	}
 	tmp := strings.Replace(strings.ToLower(in), "k", "000", -1)
@@ -26,6 +31,16 @@ func askInput(prompt, value interface{}) (string, int64) {
 	return in, v
 }
 
+// commandGiven reports whether one of the interactive flags, those without
+// usage, is set.
+func commandGiven() bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		given = given || f.Usage == ""
+	})
+	return given
+}
+
 func HandleCommand() bool {
 	if *NopDB != "" {
 		var lines []int
@@ -50,8 +65,31 @@ func HandleCommand() bool {
 
 	if *ConfigCmd {
 		_, db.Config.MaxPostSize = askInput("Global post size", db.Config.MaxPostSize)
+		_, db.Config.MaxArticleSize = askInput("Max article size read, headers included", db.Config.MaxArticleSize)
 		_, db.Config.ThrotCmdWin = askInput("Throt # of NNTP commands", db.Config.ThrotCmdWin)
 		_, db.Config.PostIntervalSec = askInput("Cooldown seconds between two posts", db.Config.PostIntervalSec)
+		_, legacy := askInput("Allow mods to delete by 'Subject: d' (0/1)", common.BoolInt(db.Config.LegacyDelete == nil || *db.Config.LegacyDelete))
+		db.Config.LegacyDelete = new(bool)
+		*db.Config.LegacyDelete = legacy != 0
+		_, history := askInput("Keep earlier revisions of superseded articles (0/1)", common.BoolInt(db.Config.KeepHistory))
+		db.Config.KeepHistory = history != 0
+		db.Config.SuckAddr, _ = askInput("Upstream server to suck from (host:port)", db.Config.SuckAddr)
+		db.Config.SuckGroups, _ = askInput("Groups to suck (wildmat)", db.Config.SuckGroups)
+		db.Config.AdminToken, _ = askInput("Admin API token (empty: disabled)", db.Config.AdminToken)
+		_, db.Config.MaxConns = askInput("Max connections (0: unlimited)", db.Config.MaxConns)
+		_, perIP := askInput("Max connections per IP, IPv6 per /64 (0: unlimited)", *db.Config.MaxConnsPerIP)
+		db.Config.MaxConnsPerIP = &perIP
+		_, perUser := askInput("Max connections per user (0: unlimited)", *db.Config.MaxConnsPerUser)
+		db.Config.MaxConnsPerUser = &perUser
+		db.Config.ExemptHosts, _ = askInput("IPs/CIDRs exempt from connection limits (comma separated)", db.Config.ExemptHosts)
+		db.Config.ProxyHosts, _ = askInput("IPs/CIDRs of proxies using the PROXY protocol (comma separated)", db.Config.ProxyHosts)
+		db.Config.ClientCA, _ = askInput("CA file verifying TLS client certificates (empty: disabled)", db.Config.ClientCA)
+		_, bindFrom := askInput("Restrict users to their registered From addresses (0/1)", common.BoolInt(db.Config.BindFrom))
+		db.Config.BindFrom = bindFrom != 0
+		db.Config.AnonymousFrom, _ = askInput("From of anonymous posts (empty: as posted)", db.Config.AnonymousFrom)
+		_, db.Config.DataFileSize = askInput("Start a new data file beyond size", db.Config.DataFileSize)
+		db.Config.Durability, _ = askInput("Fsync (none, batch: every second, post: every write)", db.Config.Durability)
+		db.Config.Auth, _ = askInput("Authenticators (comma separated: accounts, htpasswd:<file>, exec:<command>)", db.Config.Auth)
 		p := bytes.NewBufferString("\nC")
 		json.NewEncoder(p).Encode(db.Config)
 		common.PanicIf(db.WriteCommand(p.Bytes()), "%%err")
@@ -59,18 +97,60 @@ func HandleCommand() bool {
 	}
 
 	if *ModCmd != "" {
-		m := db.Mods[*ModCmd]
-		if m == nil {
+		u := db.Users[*ModCmd]
+		switch {
+		case u == nil:
 			fmt.Println("Create new mod")
-			m = &common.ModInfo{Email: *ModCmd}
-			m.Password, _ = askInput("Password", m.Password)
+			u = &common.UserInfo{Name: *ModCmd, Role: common.RoleMod}
+			pass, _ := askInput("Password", "")
+			var err error
+			u.Password, err = hashPassword(pass)
+			common.PanicIf(err, "%%err")
+		case u.Role == common.RoleAdmin:
+			fmt.Println("Refuse to demote admin", *ModCmd)
+			return true
+		case u.IsMod():
+			fmt.Println("Demote mod to user", *ModCmd)
+			u.Role = common.RoleUser
+		default:
+			fmt.Println("Promote user to mod", *ModCmd)
+			u.Role = common.RoleMod
+		}
+		common.PanicIf(db.writeUser(u), "%%err")
+		return true
+	}
+
+	if *InviteCmd {
+		inv, err := db.NewInvite("operator")
+		common.PanicIf(err, "%%err")
+		fmt.Println("Invite code:", inv.Code, "expires:", time.Unix(inv.Expires, 0))
+		return true
+	}
+
+	if *UserCmd != "" {
+		u := db.Users[*UserCmd]
+		if u == nil {
+			fmt.Println("Create new user")
+			u = &common.UserInfo{Name: *UserCmd, Role: common.RoleUser}
 		} else {
-			fmt.Println("Delete mod", *ModCmd)
-			m.Deleted = true
+			fmt.Printf("Update user, last login: %v\n", time.Unix(u.LastLogin, 0))
+			if _, del := askInput("Delete user (0/1)", 0); del != 0 {
+				u.Deleted = true
+				common.PanicIf(db.writeUser(u), "%%err")
+				return true
+			}
 		}
-		p := bytes.NewBufferString("\nm")
-		json.NewEncoder(p).Encode(m)
-		common.PanicIf(db.WriteCommand(p.Bytes()), "%%err")
+		if pass, _ := askInput("Password (empty: unchanged)", ""); pass != "" {
+			var err error
+			u.Password, err = hashPassword(pass)
+			common.PanicIf(err, "%%err")
+		}
+		u.Role, _ = askInput("Role (user/mod/admin)", u.Role)
+		u.Addresses, _ = askInput("Other From addresses (comma separated)", u.Addresses)
+		u.DisplayName, _ = askInput("Display name (empty: any)", u.DisplayName)
+		_, disabled := askInput("Disabled (0/1)", common.BoolInt(u.Disabled))
+		u.Disabled = disabled != 0
+		common.PanicIf(db.writeUser(u), "%%err")
 		return true
 	}
 
@@ -98,6 +178,107 @@ func HandleCommand() bool {
 		return true
 	}
 
+	if *PendingCmd {
+		list := db.PendingList()
+		fmt.Printf("Pending articles (%d)\n", len(list))
+		for _, p := range list {
+			msgID := p.Ref.MsgID()
+			a, err := db.loadArticle(p.Ref, true)
+			common.PanicIf(err, "%%err")
+			fmt.Printf("\n%s in %v\nFrom: %s\nSubject: %s\n", msgID, p.Groups,
+				a.Headers.Get("From"), common.TranslateEncoding(a.Headers.Get("Subject")))
+
+			switch action, _ := askInput("Approve, reject or skip (a/r/s)", "s"); action {
+			case "a":
+				common.PanicIf(db.Moderate(msgID, true, "operator", ""), "%%err")
+			case "r":
+				reason, _ := askInput("Reason", "")
+				common.PanicIf(db.Moderate(msgID, false, "operator", reason), "%%err")
+			}
+		}
+		return true
+	}
+
+	if *HistoryCmd != "" {
+		revs := db.History(common.ExtractMsgID(*HistoryCmd))
+		fmt.Printf("Earlier revisions (%d)\n", len(revs))
+		for _, r := range revs {
+			a, err := db.loadArticle(r.Ref, false)
+			if err != nil {
+				fmt.Printf("\n%v: %v\n", r, err)
+				continue
+			}
+			fmt.Printf("\n%v\nFrom: %s\nSubject: %s\n\n%s\n", r,
+				a.Headers.Get("From"), common.TranslateEncoding(a.Headers.Get("Subject")), a.Body)
+		}
+		return true
+	}
+
+	if *PeerCmd != "" {
+		pi := &common.PeerInfo{Name: *PeerCmd, Mode: "ihave", Groups: "*"}
+		if p := db.Peers[*PeerCmd]; p != nil {
+			fmt.Println("Update peer", *PeerCmd, p.Info)
+			tmp := *p.Info
+			pi = &tmp
+			if _, del := askInput("Delete peer (0/1)", 0); del != 0 {
+				pi.Deleted = true
+				common.PanicIf(db.writePeer(pi), "%%err")
+				return true
+			}
+		} else {
+			fmt.Println("Create new peer")
+		}
+		pi.Addr, _ = askInput("Address to feed (host:port, empty: incoming only)", pi.Addr)
+		pi.Groups, _ = askInput("Groups (wildmat)", pi.Groups)
+		pi.Mode, _ = askInput("Mode (ihave/stream)", pi.Mode)
+		pi.PathID, _ = askInput("Path identity (empty: host of address)", pi.PathID)
+		pi.Hosts, _ = askInput("Trusted incoming IPs/CIDRs (comma separated)", pi.Hosts)
+		pi.User, _ = askInput("Trusted login user", pi.User)
+		if pi.User != "" {
+			if pass, _ := askInput("Password (empty: unchanged)", ""); pass != "" {
+				var err error
+				pi.Password, err = hashPassword(pass)
+				common.PanicIf(err, "%%err")
+			}
+		}
+		common.PanicIf(db.writePeer(pi), "%%err")
+		return true
+	}
+
+	if *CompactCmd {
+		before, after, err := db.Compact(*DBPath)
+		common.PanicIf(err, "%%err")
+		fmt.Printf("Index compacted: %d -> %d bytes, %d saved, old index kept as %s.bak\n",
+			before, after, before-after, *DBPath)
+		return true
+	}
+
+	if *GCCmd {
+		files, moved, freed, err := db.GC()
+		common.PanicIf(err, "%%err")
+		fmt.Printf("Data files removed: %d, articles moved: %d, %s freed\n", files, moved, common.FormatSize(freed))
+		return true
+	}
+
+	if *FsckCmd {
+		problems, err := db.Fsck(*DBPath, false)
+		common.PanicIf(err, "%%err")
+		fmt.Printf("Problems found: %d\n", problems)
+		if problems == 0 {
+			return true
+		}
+		if _, repair := askInput("Repair (0/1)", 0); repair != 0 {
+			_, err := db.Fsck(*DBPath, true)
+			common.PanicIf(err, "%%err")
+		}
+		return true
+	}
+
+	if *SuckCmd {
+		common.PanicIf(db.Suck(), "%%err")
+		return true
+	}
+
 	if *GroupCmd != "" {
 		gs := db.Groups[*GroupCmd]
 		if gs == nil {
@@ -118,7 +299,11 @@ func HandleCommand() bool {
 		gs.BaseInfo.Desc, _ = askInput("Description", gs.BaseInfo.Desc)
 		_, gs.BaseInfo.MaxLives = askInput("Max live articles", gs.BaseInfo.MaxLives)
 		_, gs.BaseInfo.MaxPostSize = askInput("Max post size (0: using global setting)", gs.BaseInfo.MaxPostSize)
-		_, gs.BaseInfo.Posting = askInput("Posting (0: unlimited, 1: disbaled)", gs.BaseInfo.Posting)
+		_, gs.BaseInfo.Posting = askInput("Posting (0: unlimited, 1: disbaled, 2: moderated)", gs.BaseInfo.Posting)
+		fmt.Println("Access lists are comma separated users, @roles and IPs/CIDRs, empty for everyone")
+		gs.BaseInfo.Read, _ = askInput("Who can read", gs.BaseInfo.Read)
+		gs.BaseInfo.List, _ = askInput("Who can list (empty: same as read)", gs.BaseInfo.List)
+		gs.BaseInfo.Post, _ = askInput("Who can post", gs.BaseInfo.Post)
 		common.PanicIf(db.WriteCommand(groupInfoAdapter(gs.BaseInfo)), "%%err")
 		return true
 	}
@@ -1,9 +1,11 @@
 package common
 
 import (
+	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"net/mail"
 	"regexp"
 	"strings"
 )
@@ -15,23 +17,47 @@ func IntIf(a, b int64) int64 {
 	return a
 }
 
+func ContainsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func BoolInt(v bool) int64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
 func PanicIf(err interface{}, f string, a ...interface{}) {
 	if v, ok := err.(bool); ok {
 		if v {
-			F(f, a...)
+			Log.Fatal(fmt.Sprintf(f, a...))
 		}
 		return
 	}
 	if err != nil {
 		f = strings.Replace(f, "%%err", strings.Replace(fmt.Sprint(err), "%", "%%", -1), -1)
-		F(f, a...)
+		Log.Fatal(fmt.Sprintf(f, a...))
 	}
 }
 
+// ServerName is the right hand side of local message ids, which are
+// stored by their local part only.
+var ServerName string
+
+// ExtractMsgID returns the key an article is stored under: the local part
+// of our own message ids, foreign ones are kept whole with their brackets.
 func ExtractMsgID(msgID string) string {
 	if strings.HasPrefix(msgID, "<") && strings.HasSuffix(msgID, ">") {
-		msgID = msgID[1 : len(msgID)-1]
-		msgID = strings.Split(msgID, "@")[0]
+		parts := strings.SplitN(msgID[1:len(msgID)-1], "@", 2)
+		if len(parts) == 1 || parts[1] == ServerName {
+			return parts[0]
+		}
 	}
 	return msgID
 }
@@ -41,16 +67,23 @@ func ExtractEmail(from string) string {
 	if start > -1 && end > -1 && end > start {
 		return from[start+1 : end]
 	}
+	// Bare "addr" or "addr (Name)" forms
+	if a, err := mail.ParseAddress(from); err == nil {
+		return a.Address
+	}
 	return ""
 }
 
 func MsgIDToRawMsgID(msgid string, msgidbuf []byte) [16]byte {
 	var x [16]byte
 	if msgidbuf != nil {
-		copy(x[:], msgidbuf)
-	} else {
-		copy(x[:], msgid)
+		msgid = string(msgidbuf)
+	}
+	if strings.HasPrefix(msgid, "<") {
+		// Foreign ids are too long to be kept inline
+		return md5.Sum([]byte(msgid))
 	}
+	copy(x[:], msgid)
 	return x
 }
 
@@ -24,3 +24,48 @@ func TestAA(t *testing.T) {
 		t.Log(x, start, "->", s, "\t", end, "->", e)
 	}
 }
+
+func TestSkip(t *testing.T) {
+	s := &HighLowSlice{}
+	s.Skip(5)
+	s.Append(&ArticleRef{Offset: 5})
+	s.Skip(8)
+	s.Append(&ArticleRef{Offset: 8})
+	if s.Low() != 5 || s.High() != 9 {
+		t.Fatal(s)
+	}
+	if ar, ok := s.Get(5); !ok || ar.Offset != 5 {
+		t.Fatal(s)
+	}
+	if ar, ok := s.Get(6); !ok || ar != nil {
+		t.Fatal(s)
+	}
+	if ar, ok := s.Get(8); !ok || ar.Offset != 8 {
+		t.Fatal(s)
+	}
+}
+
+func TestMsgID(t *testing.T) {
+	ServerName = "news.example"
+	for in, out := range map[string]string{
+		"<abc@news.example>": "abc",
+		"<abc>":              "abc",
+		"abc":                "abc",
+		"<abc@peer.example>": "<abc@peer.example>",
+	} {
+		if v := ExtractMsgID(in); v != out {
+			t.Fatalf("ExtractMsgID(%q) = %q, want %q", in, v, out)
+		}
+	}
+
+	ar := &ArticleRef{}
+	ar.SetMsgID("<a-very-long-message-id@peer.example>")
+	if ar.MsgID() != "<a-very-long-message-id@peer.example>" ||
+		ar.RawMsgID != MsgIDToRawMsgID("", []byte(ar.MsgID())) {
+		t.Fatal(ar.MsgID())
+	}
+	ar.SetMsgID("abc")
+	if ar.MsgID() != "abc" || ar.RawMsgID != MsgIDToRawMsgID("abc", nil) {
+		t.Fatal(ar.MsgID())
+	}
+}
@@ -2,6 +2,7 @@ package font
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -13,6 +14,6 @@ func TestDraw(t *testing.T) {
 	tb.Gray = true
 	tb.Underline = false
 	tb.Write("\ngray\ttext")
-	of, _ := os.Create("1.png")
+	of, _ := os.Create(filepath.Join(t.TempDir(), "1.png"))
 	tb.End(of)
 }
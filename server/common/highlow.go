@@ -97,3 +97,20 @@ func (s *HighLowSlice) Append(v *ArticleRef) ([]*ArticleRef, int) {
 	}
 	return purged, s.high
 }
+
+// Skip moves high to n leaving empty slots, an empty slice starts at n.
+// Compacted indexes use it to keep article numbers.
+func (s *HighLowSlice) Skip(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n <= s.high {
+		return
+	}
+	if len(s.d) == 0 {
+		s.low, s.high = n, n
+		return
+	}
+	for ; s.high < n; s.high++ {
+		s.d = append(s.d, nil)
+	}
+}
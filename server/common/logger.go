@@ -1,50 +1,204 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-var Verbose = 1
+type Level int
 
-func D(f string, a ...interface{}) {
-	if Verbose <= 0 {
-		logger(0, f, a...)
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+	LevelFatal
+)
+
+var levelNames = [...]string{"debug", "info", "error", "fatal"}
+
+// Text lines keep the one letter lead of the old logger
+var levelLeads = [...]string{"I", "M", "e", "F"}
+
+func (lv Level) String() string {
+	if lv < LevelDebug || lv > LevelFatal {
+		return strconv.Itoa(int(lv))
 	}
+	return levelNames[lv]
 }
 
-func L(f string, a ...interface{}) {
-	if Verbose <= 1 {
-		logger(1, f, a...)
-	}
+// A Logger writes leveled lines made of a message and key/value fields.
+// Loggers derived by With share the output and level of their parent.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
 }
 
-func E(f string, a ...interface{}) {
-	if Verbose <= 2 {
-		logger(2, f, a...)
-	}
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	json  bool
+	level Level
+}
+
+// Log is the root logger, writing text lines of level info and above to
+// stdout until configured by SetOutput.
+var Log = &Logger{out: &logOutput{w: os.Stdout, level: LevelInfo}}
+
+// SetOutput changes where l and every logger derived from it write.
+func (l *Logger) SetOutput(w io.Writer, json bool, level Level) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w, l.out.json, l.out.level = w, json, level
+}
+
+// With returns a logger adding the key/value pairs kv to every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	return &Logger{out: l.out, fields: append(append(fields, l.fields...), kv...)}
 }
 
-func F(f string, a ...interface{}) {
-	logger(3, f, a...)
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.output(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.output(LevelInfo, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.output(LevelError, msg, kv) }
+
+// Fatal logs at fatal level and exits with status 3.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.output(LevelFatal, msg, kv)
 	os.Exit(3)
 }
 
-func logger(lv int, f string, a ...interface{}) {
+func (l *Logger) output(lv Level, msg string, kv []interface{}) {
+	o := l.out
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if lv < o.level {
+		return
+	}
+
 	_, file, ln, _ := runtime.Caller(2)
-	file = filepath.Base(file)
+	caller := filepath.Base(file) + ":" + strconv.Itoa(ln)
+	now := time.Now()
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+
+	if o.json {
+		m := map[string]interface{}{
+			"time":   now.Format(time.RFC3339Nano),
+			"level":  lv.String(),
+			"caller": caller,
+			"msg":    msg,
+		}
+		for i := 0; i < len(fields); i += 2 {
+			m[fmt.Sprint(fields[i])] = logValue(fields, i+1, false)
+		}
+		buf, _ := json.Marshal(m)
+		o.w.Write(append(buf, '\n'))
+		return
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s %s % 16s] %s", levelLeads[lv], now.Format("0102 15:04:05.000"), caller, msg)
+	for i := 0; i < len(fields); i += 2 {
+		fmt.Fprintf(b, " %v=%v", fields[i], logValue(fields, i+1, true))
+	}
+	b.WriteByte('\n')
+	io.WriteString(o.w, b.String())
+}
+
+// logValue returns fields[i] fit for output, quoted in text lines when needed.
+func logValue(fields []interface{}, i int, text bool) interface{} {
+	if i >= len(fields) {
+		return "MISSING"
+	}
+	v := fields[i]
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case fmt.Stringer:
+		v = x.String()
+	}
+	if !text {
+		if _, err := json.Marshal(v); err != nil {
+			return fmt.Sprint(v)
+		}
+		return v
+	}
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// RotatingFile is a log file which is renamed to name.1 (name.1 to name.2
+// and so on, up to Keep files) when it grows beyond MaxSize.
+type RotatingFile struct {
+	Name    string
+	MaxSize int64
+	Keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func OpenRotatingFile(name string, maxSize int64, keep int) (*RotatingFile, error) {
+	r := &RotatingFile{Name: name, MaxSize: maxSize, Keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
 
-	lead := "I"
-	switch lv {
-	case 1:
-		lead = "M"
-	case 2:
-		lead = "e"
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.MaxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
 	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	r.f.Close()
+	for i := r.Keep - 1; i > 0; i-- {
+		os.Rename(r.Name+"."+strconv.Itoa(i), r.Name+"."+strconv.Itoa(i+1))
+	}
+	if r.Keep > 0 {
+		os.Rename(r.Name, r.Name+".1")
+	} else {
+		os.Remove(r.Name)
+	}
+	return r.open()
+}
 
-	fmt.Printf("%s %s % 12s:%03d] ", lead, time.Now().Format("0102 15:04:05.000"), file, ln)
-	fmt.Println(fmt.Sprintf(f, a...))
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
 }
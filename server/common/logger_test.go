@@ -0,0 +1,80 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := &Logger{out: &logOutput{}}
+	l.SetOutput(buf, false, LevelInfo)
+
+	s := l.With("session", 1, "remote", "192.0.2.1:119")
+	s.Debug("hidden")
+	s.Info("post", "group", "a.b", "subject", "hello world")
+	line := buf.String()
+	if strings.Contains(line, "hidden") || !strings.HasPrefix(line, "M ") ||
+		!strings.HasSuffix(line, `] post session=1 remote=192.0.2.1:119 group=a.b subject="hello world"`+"\n") {
+		t.Fatalf("text line: %q", line)
+	}
+
+	buf.Reset()
+	l.SetOutput(buf, true, LevelDebug)
+	s.Error("failed", "err", os.ErrNotExist)
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["level"] != "error" || m["msg"] != "failed" || m["session"] != 1.0 || m["err"] != os.ErrNotExist.Error() {
+		t.Fatalf("json line: %v", m)
+	}
+}
+
+func TestFatal(t *testing.T) {
+	if os.Getenv("LOGGER_FATAL") != "" {
+		l := &Logger{out: &logOutput{}}
+		l.SetOutput(os.Stdout, false, LevelInfo)
+		l.Fatal("bye")
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFatal$")
+	cmd.Env = append(os.Environ(), "LOGGER_FATAL=1")
+	out, err := cmd.Output()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 3 || !strings.Contains(string(out), "bye") {
+		t.Fatalf("Fatal: %v, %q", err, out)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "enn.log")
+	r, err := OpenRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		r.Write([]byte(s))
+	}
+	r.Close()
+
+	for name, want := range map[string]string{name: "dddddddd\n", name + ".1": "cccccccc\n", name + ".2": "bbbbbbbb\n"} {
+		if buf, _ := ioutil.ReadFile(name); string(buf) != want {
+			t.Fatalf("%s: %q, want %q", name, buf, want)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); err == nil {
+		t.Fatal("kept too many files")
+	}
+}
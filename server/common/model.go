@@ -7,16 +7,32 @@ import (
 	"fmt"
 	"io"
 	"net/textproto"
+	"strings"
 )
 
 type ArticleRef struct {
 	Index    int
 	RawMsgID [16]byte
-	Offset   int64
-	Length   int64
+	// ForeignID is the whole Message-ID of articles from other servers,
+	// whose RawMsgID is a hash.
+	ForeignID string
+	Offset    int64
+	Length    int64
+}
+
+// SetMsgID sets the id returned by ExtractMsgID.
+func (ar *ArticleRef) SetMsgID(msgID string) {
+	ar.RawMsgID = MsgIDToRawMsgID(msgID, nil)
+	ar.ForeignID = ""
+	if strings.HasPrefix(msgID, "<") {
+		ar.ForeignID = msgID
+	}
 }
 
 func (ar *ArticleRef) MsgID() string {
+	if ar.ForeignID != "" {
+		return ar.ForeignID
+	}
 	return string(bytes.Trim(ar.RawMsgID[:], "\x00"))
 }
 
@@ -63,6 +79,11 @@ type BaseGroupInfo struct {
 	MaxPostSize int64  `json:",omitempty"`
 	MaxLives    int64  `json:",omitempty"`
 	CreateTime  int64  `json:",omitempty"`
+	Deleted     bool   `json:",omitempty"`
+	// Access control lists, see acl in the server. Empty allows everyone.
+	List string `json:",omitempty"`
+	Read string `json:",omitempty"`
+	Post string `json:",omitempty"`
 }
 
 func (g BaseGroupInfo) Diff(g2 *BaseGroupInfo) string {
@@ -84,27 +105,192 @@ func (g BaseGroupInfo) Diff(g2 *BaseGroupInfo) string {
 	if g.CreateTime == g2.CreateTime {
 		g.CreateTime = 0
 	}
+	if g.Deleted == g2.Deleted {
+		g.Deleted = false
+	}
+	if g.List == g2.List {
+		g.List = ""
+	}
+	if g.Read == g2.Read {
+		g.Read = ""
+	}
+	if g.Post == g2.Post {
+		g.Post = ""
+	}
 	buf, _ := json.Marshal(g)
 	return string(buf)
 }
 
+// ModInfo is a legacy m record with a plaintext password, migrated to a
+// UserInfo when loading the index.
 type ModInfo struct {
 	Email    string
 	Password string
 	Deleted  bool
 }
 
-func (m *ModInfo) String() string {
+const (
+	RoleUser  = "user"
+	RoleMod   = "mod"
+	RoleAdmin = "admin"
+)
+
+// UserInfo is an account, stored as U records, the last one wins.
+type UserInfo struct {
+	Name string
+	// Password is a bcrypt hash.
+	Password string
+	// Role is RoleUser, RoleMod or RoleAdmin, empty means RoleUser.
+	Role      string `json:",omitempty"`
+	Disabled  bool   `json:",omitempty"`
+	LastLogin int64  `json:",omitempty"`
+	Deleted   bool   `json:",omitempty"`
+	// Addresses are the comma separated From addresses of the user besides
+	// its name if that is one, DisplayName the name going with them.
+	Addresses   string `json:",omitempty"`
+	DisplayName string `json:",omitempty"`
+}
+
+// Emails returns the registered From addresses of the user.
+func (u *UserInfo) Emails() []string {
+	var rv []string
+	if strings.Contains(u.Name, "@") {
+		rv = append(rv, u.Name)
+	}
+	for _, a := range strings.Split(u.Addresses, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			rv = append(rv, a)
+		}
+	}
+	return rv
+}
+
+// Owns reports whether addr is one of the registered addresses of the user.
+func (u *UserInfo) Owns(addr string) bool {
+	for _, a := range u.Emails() {
+		if strings.EqualFold(a, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// InviteInfo is a single use registration code, stored as I records, the
+// last one wins. UsedBy is set once it has been redeemed.
+type InviteInfo struct {
+	Code    string
+	By      string
+	Created int64
+	Expires int64
+	UsedBy  string `json:",omitempty"`
+	Used    int64  `json:",omitempty"`
+}
+
+// IsMod reports whether the account can moderate, admins included.
+func (u *UserInfo) IsMod() bool {
+	return u.Role == RoleMod || u.Role == RoleAdmin
+}
+
+// ModAction records a moderation decision in the index.
+type ModAction struct {
+	Action string
+	MsgID  string  `json:",omitempty"`
+	Group  string  `json:",omitempty"`
+	Target string  `json:",omitempty"`
+	By     string  `json:",omitempty"`
+	Reason string  `json:",omitempty"`
+	Ref    []int64 `json:",omitempty"`
+	Time   int64
+}
+
+func (m *ModAction) String() string {
 	buf, _ := json.Marshal(m)
 	return string(buf)
 }
 
 type AuthObject struct {
-	User, Pass string
+	User, Role string
+	// Account is set for sessions of index accounts, whose role follows
+	// the account rather than staying as it was at login.
+	Account bool
 }
 
 type Config struct {
-	MaxPostSize     int64
+	MaxPostSize int64
+	// MaxArticleSize limits whole articles on the wire, headers included,
+	// while they are read. Unset, the post size with room for headers.
+	MaxArticleSize  int64 `json:",omitempty"`
 	ThrotCmdWin     int64
 	PostIntervalSec int64
+	// LegacyDelete lets mods delete the referred article by posting with
+	// 'Subject: d'. Unset means on, as it was before being an option.
+	LegacyDelete *bool  `json:",omitempty"`
+	KeepHistory  bool   `json:",omitempty"`
+	CancelSecret string `json:",omitempty"`
+	SuckAddr     string `json:",omitempty"`
+	SuckGroups   string `json:",omitempty"`
+	AdminToken   string `json:",omitempty"`
+	MaxConns     int64  `json:",omitempty"`
+	// MaxConnsPerIP and MaxConnsPerUser are 0 when disabled, unset ones
+	// get the default.
+	MaxConnsPerIP   *int64 `json:",omitempty"`
+	MaxConnsPerUser *int64 `json:",omitempty"`
+	// ExemptHosts are IPs and CIDRs exempt from the connection limits.
+	ExemptHosts string `json:",omitempty"`
+	// ProxyHosts are the IPs and CIDRs of proxies sending a PROXY protocol header.
+	ProxyHosts string `json:",omitempty"`
+	// Auth lists the authenticators, see newAuthenticator.
+	Auth string `json:",omitempty"`
+	// BindFrom restricts users to their registered From addresses.
+	BindFrom bool `json:",omitempty"`
+	// AnonymousFrom replaces the From of posts by anonymous sessions.
+	AnonymousFrom string `json:",omitempty"`
+	// ClientCA is a PEM file of the CAs verifying TLS client certificates,
+	// which log sessions in as the account named by the certificate.
+	ClientCA string `json:",omitempty"`
+	// DataFileSize is the size beyond which a new data file is started.
+	DataFileSize int64 `json:",omitempty"`
+	// Durability is when writes are fsynced: none, batch (every second,
+	// the default) or post (every write).
+	Durability string `json:",omitempty"`
+}
+
+// Redacted returns c as JSON with its secrets masked, for logging.
+func (c Config) Redacted() string {
+	if c.CancelSecret != "" {
+		c.CancelSecret = "redacted"
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = "redacted"
+	}
+	buf, _ := json.Marshal(c)
+	return string(buf)
+}
+
+// PeerInfo describes a server we exchange articles with. Articles are fed
+// to Addr, peers without one only send to us. Transfers from Hosts or from
+// sessions logged in as User are trusted.
+type PeerInfo struct {
+	Name string
+	Addr string `json:",omitempty"`
+	// Groups is a wildmat selecting the articles to feed. Groups with a
+	// Read list are only fed to the peers it names.
+	Groups string
+	// Mode is "ihave" or "stream" (CHECK/TAKETHIS).
+	Mode string `json:",omitempty"`
+	// PathID is the peer's path identity, articles whose Path already
+	// contains it are not offered. Defaults to the host of Addr.
+	PathID string `json:",omitempty"`
+	// Hosts is a comma separated list of IPs and CIDRs the peer connects from.
+	Hosts string `json:",omitempty"`
+	User  string `json:",omitempty"`
+	// Password is a bcrypt hash, plaintext ones of old records are hashed
+	// when loading.
+	Password string `json:",omitempty"`
+	Deleted  bool   `json:",omitempty"`
+}
+
+func (p *PeerInfo) String() string {
+	buf, _ := json.Marshal(p)
+	return string(buf)
 }
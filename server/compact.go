@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coyove/enn/server/common"
+)
+
+// Compact rewrites the index at path from the loaded state, dropping
+// tombstones, purged and cancelled articles, overwritten records and
+// blanked lines. Article numbers are kept by N records skipping the gaps.
+// The new index is written aside and renamed over path, the old one stays
+// as path.bak. The index is locked first, so this fails while the server
+// runs, it would go on writing to path.bak.
+func (db *Backend) Compact(path string) (before, after int64, err error) {
+	if err := lockIndex(db.Index); err != nil {
+		return 0, 0, err
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = st.Size()
+
+	tmp := path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	err = db.writeCompact(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if st, err = os.Stat(tmp); err != nil {
+		return 0, 0, err
+	}
+	after = st.Size()
+
+	// The index is never missing: path.bak is a link to the old one
+	// before the new one is renamed over it
+	os.Remove(path + ".bak")
+	if err := os.Link(path, path+".bak"); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
+
+func (db *Backend) writeCompact(w io.Writer) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	buf := &bytes.Buffer{}
+	record := func(tag string, v interface{}) {
+		buf.WriteString("\n" + tag)
+		json.NewEncoder(buf).Encode(v)
+		buf.Truncate(buf.Len() - 1) // Encode appends a newline
+	}
+
+	record("C", db.rawConfig)
+	for _, u := range db.Users {
+		record("U", u)
+	}
+	now := time.Now().Unix()
+	for _, inv := range db.Invites {
+		// Expired invites are of no use, used ones tell who invited whom
+		if inv.UsedBy != "" || inv.Expires > now {
+			record("I", inv)
+		}
+	}
+	for name, ipnet := range db.Blacklist {
+		fmt.Fprintf(buf, "\nB%s %s", name, ipnet)
+	}
+	for _, p := range db.Peers {
+		record("F", p.Info)
+	}
+	for key, mark := range db.SuckMarks {
+		fmt.Fprintf(buf, "\nS%s %d", key, mark)
+	}
+	if _, err := w.Write(sumLines(buf.Bytes())); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(db.Groups))
+	for name := range db.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := db.Groups[name]
+		buf.Reset()
+		record("G", g.BaseInfo)
+		writeSlots(buf, g, func(ar *common.ArticleRef) bool {
+			return db.Articles[ar.RawMsgID] != nil
+		}, func(ar *common.ArticleRef) {
+			// Slots refer to articles by id, the live ref is the one to keep
+			live := db.Articles[ar.RawMsgID]
+			fmt.Fprintf(buf, "\nA%s %s %d %s %s", name, live.MsgID(), live.Index,
+				strconv.FormatInt(live.Offset, 36), strconv.FormatInt(live.Length, 36))
+		})
+		if _, err := w.Write(sumLines(buf.Bytes())); err != nil {
+			return err
+		}
+	}
+
+	buf.Reset()
+	writeSlots(buf, db.Pending, func(ar *common.ArticleRef) bool {
+		return db.PendingArticles[ar.RawMsgID] != nil
+	}, func(ar *common.ArticleRef) {
+		p := db.PendingArticles[ar.RawMsgID]
+		fmt.Fprintf(buf, "\nP%s %d %s %s %s", p.Ref.MsgID(), p.Ref.Index, strconv.FormatInt(p.Ref.Offset, 36),
+			strconv.FormatInt(p.Ref.Length, 36), strings.Join(p.Groups, ","))
+	})
+	for _, s := range db.Superseded {
+		record("R", &common.ModAction{
+			Action: "supersede",
+			MsgID:  s.Ref.MsgID(),
+			Target: s.NewID,
+			Ref:    []int64{int64(s.Ref.Index), s.Ref.Offset, s.Ref.Length},
+			Time:   s.Time,
+		})
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(sumLines(buf.Bytes()))
+	return err
+}
+
+// writeSlots writes the live slots of g, with an N record before those
+// following a gap and one for the gap at the end.
+func writeSlots(buf *bytes.Buffer, g *Group, live func(*common.ArticleRef) bool, write func(*common.ArticleRef)) {
+	refs, start, _ := g.Articles.Slice(0, g.Articles.High(), true)
+	next := 0
+	for i, ar := range refs {
+		if ar == nil || !live(ar) {
+			continue
+		}
+		if n := start + i; n != next {
+			fmt.Fprintf(buf, "\nN%s %d", g.Group.Name, n)
+			next = n
+		}
+		write(ar)
+		next++
+	}
+	if high := g.Articles.High(); next != high {
+		fmt.Fprintf(buf, "\nN%s %d", g.Group.Name, high)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/coyove/enn/server/common"
+)
+
+// snapshot describes what clients see of db: the articles of each group by
+// number with their content, the pending articles and earlier revisions.
+func snapshot(t *testing.T, db *Backend) string {
+	t.Helper()
+	content := func(ar *common.ArticleRef) string {
+		a, err := db.loadArticle(ar, false)
+		if err != nil {
+			t.Fatalf("load %s: %v", ar.MsgID(), err)
+		}
+		return fmt.Sprintf("%s %q", ar.MsgID(), a.Body)
+	}
+
+	var lines []string
+	for name, g := range db.Groups {
+		lines = append(lines, fmt.Sprintf("group %s %d %d-%d", name, g.Group.Count, g.Group.Low, g.Group.High))
+		refs, start, _ := g.Articles.Slice(0, g.Articles.High(), true)
+		for i, ar := range refs {
+			if ar != nil && db.Articles[ar.RawMsgID] != nil {
+				lines = append(lines, fmt.Sprintf("article %s %d %s", name, start+i+1, content(db.Articles[ar.RawMsgID])))
+			}
+		}
+	}
+	for _, p := range db.PendingArticles {
+		lines = append(lines, fmt.Sprintf("pending %d %s %s", p.Num, strings.Join(p.Groups, ","), content(p.Ref)))
+	}
+	for _, s := range db.Superseded {
+		lines = append(lines, fmt.Sprintf("revision %s %s", s.NewID, content(s.Ref)))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// fillTestDB posts articles leaving gaps in the numbering: deleted ones and
+// a pending one. Purges are random, replaying the index may purge others.
+func fillTestDB(t *testing.T, db *Backend) {
+	t.Helper()
+	for i := 0; i < 5; i++ {
+		postTestArticle(t, db, "test.a", fmt.Sprintf("<a%d@fill.test>", i), i)
+	}
+	postTestArticle(t, db, "test.a,test.b", "<x@fill.test>", 10)
+	for i := 0; i < 4; i++ {
+		postTestArticle(t, db, "test.b", fmt.Sprintf("<b%d@fill.test>", i), 20+i)
+	}
+	postTestArticle(t, db, "test.m", "<m0@fill.test>", 30)
+	for _, id := range []string{"<a1@fill.test>", "<a4@fill.test>", "<b0@fill.test>", "<b1@fill.test>"} {
+		if err := db.DeleteArticle(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var fillGroups = []string{
+	`G{"Name":"test.a","MaxLives":100}`,
+	`G{"Name":"test.b","MaxLives":100}`,
+	`G{"Name":"test.m","MaxLives":100,"Posting":2}`,
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idx")
+	db := openTestDB(t, path, "a.example", fillGroups...)
+	fillTestDB(t, db)
+	want := snapshot(t, db)
+	if len(db.PendingArticles) != 1 {
+		t.Fatalf("%d pending articles", len(db.PendingArticles))
+	}
+
+	before, after, err := db.Compact(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Fatalf("index grew from %d to %d", before, after)
+	}
+	if _, err := os.Stat(path + ".bak"); err != nil {
+		t.Fatal(err)
+	}
+	// Defaults are not written out, later ones may differ
+	buf, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(buf), "DataFileSize") || !strings.Contains(string(buf), "CancelSecret") {
+		t.Fatalf("config not kept as recorded:\n%s", buf)
+	}
+
+	closeTestDB(db)
+	db = openTestDB(t, path, "a.example")
+	if got := snapshot(t, db); got != want {
+		t.Fatalf("compacted index differs:\n%s\n\nwanted:\n%s", got, want)
+	}
+
+	// Numbering goes on after the kept ones
+	postTestArticle(t, db, "test.a", "<a5@fill.test>", 40)
+	if ar, _ := db.Groups["test.a"].Articles.Get(6); ar == nil || ar.MsgID() != "<a5@fill.test>" {
+		t.Fatalf("new article not numbered 7: %v", ar)
+	}
+}
+
+func TestIndexLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idx")
+	openTestDB(t, path, "a.example")
+	if err := LoadIndex(path, &Backend{}, true); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("index opened twice: %v", err)
+	}
+
+	// Commands load next to the server, only those rewriting files refuse
+	cmd := &Backend{}
+	if err := LoadIndex(path, cmd, false); err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(cmd)
+	if err := cmd.WriteCommand([]byte("\nB127.0.0.1/32")); err != nil {
+		t.Fatal(err)
+	}
+	_, _, compact := cmd.Compact(path)
+	_, _, _, gc := cmd.GC()
+	_, fsck := cmd.Fsck(path, true)
+	for _, err := range []error{compact, gc, fsck} {
+		if err == nil || !strings.Contains(err.Error(), "in use") {
+			t.Fatalf("rewritten while in use: %v", err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/coyove/enn"
+	"github.com/coyove/enn/server/common"
+)
+
+// control applies an RFC 5537 control message (cancel, newgroup, rmgroup
+// and checkgroups). Control messages are authorised against the mod list,
+// except cancels of articles whose Cancel-Lock the poster can unlock. Every
+// applied one is recorded in the index as an R record.
+func (db *Backend) control(article *enn.Article) error {
+	args := strings.Fields(article.Header.Get("Control"))
+	if len(args) == 0 {
+		return &enn.NNTPError{Code: 441, Msg: "Empty Control header"}
+	}
+	verb := strings.ToLower(args[0])
+	args = args[1:]
+
+	act := &common.ModAction{
+		Action: verb,
+		By:     db.posterID(article),
+		Time:   time.Now().Unix(),
+	}
+
+	// Posters may cancel their own articles with a matching Cancel-Key,
+	// anything else needs a mod
+	if verb != "cancel" {
+		if db.AuthObject == nil {
+			return enn.ErrNotAuthenticated
+		}
+		if !db.IsMod() {
+			return enn.ErrNotMod
+		}
+	}
+
+	switch verb {
+	case "cancel":
+		if len(args) != 1 || !enn.ValidMessageID(args[0]) {
+			return &enn.NNTPError{Code: 441, Msg: "Usage: cancel <message-id>"}
+		}
+		act.MsgID = common.ExtractMsgID(args[0])
+		ar, ok := db.internalGetArticle(act.MsgID)
+		if !ok {
+			return enn.ErrInvalidMessageID
+		}
+		if !db.IsMod() {
+			old, err := db.loadArticle(ar, true)
+			if err != nil {
+				return err
+			}
+			if !db.canCancel(old, act.MsgID, article) {
+				return &enn.NNTPError{Code: 441, Msg: "Cancel not authorized, Cancel-Key required"}
+			}
+		}
+		if err := db.DeleteArticle(act.MsgID); err != nil {
+			return err
+		}
+	case "newgroup":
+		if len(args) < 1 || !enn.ValidGroupName(args[0]) {
+			return &enn.NNTPError{Code: 441, Msg: "Usage: newgroup <newsgroup> [moderated]"}
+		}
+		body, _ := ioutil.ReadAll(article.Body)
+		info := &common.BaseGroupInfo{
+			Name:       args[0],
+			Desc:       controlGroupDescs(body)[args[0]],
+			MaxLives:   1000,
+			CreateTime: time.Now().Unix(),
+		}
+		if old, ok := db.internalGetGroup(args[0]); ok {
+			tmp := *old.BaseInfo
+			info = &tmp
+			if d := controlGroupDescs(body)[args[0]]; d != "" {
+				info.Desc = d
+			}
+		}
+		// Without "moderated" the group is unmoderated, local read-only ones stay so
+		if len(args) > 1 && strings.ToLower(args[1]) == "moderated" {
+			info.Posting = 2
+		} else if info.Posting == 2 {
+			info.Posting = 0
+		}
+		act.Group = args[0]
+		if err := db.writeGroup(info); err != nil {
+			return err
+		}
+	case "rmgroup":
+		if len(args) != 1 {
+			return &enn.NNTPError{Code: 441, Msg: "Usage: rmgroup <newsgroup>"}
+		}
+		gs, ok := db.internalGetGroup(args[0])
+		if !ok {
+			return enn.ErrNoSuchGroup
+		}
+		info := *gs.BaseInfo
+		info.Deleted = true
+		act.Group = args[0]
+		if err := db.writeGroup(&info); err != nil {
+			return err
+		}
+	case "checkgroups":
+		body, _ := ioutil.ReadAll(article.Body)
+		if err := db.checkGroups(controlGroupDescs(body), act); err != nil {
+			return err
+		}
+	default:
+		return &enn.NNTPError{Code: 441, Msg: "Unsupported control message: " + verb}
+	}
+
+	db.log.Info("control", "action", act)
+	return db.writeModAction(act)
+}
+
+// checkGroups makes the hierarchies named in a checkgroups body match it:
+// missing groups are created, descriptions updated and groups not listed
+// removed.
+func (db *Backend) checkGroups(descs map[string]string, act *common.ModAction) error {
+	if len(descs) == 0 {
+		return &enn.NNTPError{Code: 441, Msg: "Empty checkgroups"}
+	}
+
+	hierarchies := map[string]bool{}
+	for name := range descs {
+		hierarchies[strings.Split(name, ".")[0]] = true
+	}
+
+	var changes []*common.BaseGroupInfo
+	db.mu.RLock()
+	for name, desc := range descs {
+		if g := db.Groups[name]; g == nil {
+			changes = append(changes, &common.BaseGroupInfo{
+				Name:       name,
+				Desc:       desc,
+				MaxLives:   1000,
+				CreateTime: time.Now().Unix(),
+			})
+		} else if g.BaseInfo.Desc != desc {
+			info := *g.BaseInfo
+			info.Desc = desc
+			changes = append(changes, &info)
+		}
+	}
+	for name, g := range db.Groups {
+		if _, listed := descs[name]; !listed && hierarchies[strings.Split(name, ".")[0]] {
+			info := *g.BaseInfo
+			info.Deleted = true
+			changes = append(changes, &info)
+		}
+	}
+	db.mu.RUnlock()
+
+	var names []string
+	for _, info := range changes {
+		if err := db.writeGroup(info); err != nil {
+			return err
+		}
+		names = append(names, info.Name)
+	}
+	act.Reason = strings.Join(names, ",")
+	return nil
+}
+
+// controlGroupDescs parses "name<whitespace>description" lines found in the
+// body of newgroup and checkgroups messages.
+func controlGroupDescs(body []byte) map[string]string {
+	descs := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(body))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if !enn.ValidGroupName(fields[0]) || !strings.Contains(fields[0], ".") {
+			continue
+		}
+		descs[fields[0]] = strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+	}
+	return descs
+}
+
+// writeGroup records a group change in the index and applies it.
+func (db *Backend) writeGroup(info *common.BaseGroupInfo) error {
+	if err := db.writeIndex(groupInfoAdapter(info)); err != nil {
+		return err
+	}
+	return db.setGroup(info, false)
+}
+
+func (db *Backend) writeModAction(act *common.ModAction) error {
+	buf := bytes.NewBufferString("\nR")
+	json.NewEncoder(buf).Encode(act)
+	return db.writeIndex(buf.Bytes())
+}
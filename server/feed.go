@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/enn"
+	"github.com/coyove/enn/server/common"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	feedTimeout    = time.Minute
+	feedMinBackoff = time.Second
+	feedMaxBackoff = 5 * time.Minute
+	// Delivery positions are saved at most this often
+	backlogSaveInterval = time.Second
+	// streamWindow is how many CHECK and TAKETHIS commands are in flight
+	streamWindow = 16
+)
+
+// peer is a server we feed articles to. Accepted articles are queued in
+// an on-disk backlog, one Message-ID per line, and delivered in order by
+// a goroutine per peer. Control messages are applied but not stored, so
+// they are not fed: peers get cancels and group changes from elsewhere.
+type peer struct {
+	Info    *common.PeerInfo
+	hosts   []*net.IPNet
+	backlog *backlog
+	wake    chan struct{}
+}
+
+func newPeer(info *common.PeerInfo) *peer {
+	p := &peer{Info: info, wake: make(chan struct{}, 1)}
+	p.setInfo(info)
+	return p
+}
+
+func (p *peer) setInfo(info *common.PeerInfo) {
+	p.Info, p.hosts = info, parseHosts(info.Hosts)
+}
+
+func (p *peer) allows(ip net.IP) bool {
+	return hostsContain(p.hosts, ip)
+}
+
+// parseHosts parses a comma separated list of IPs and CIDRs.
+func parseHosts(hosts string) (rv []*net.IPNet) {
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if !strings.Contains(h, "/") {
+			if ip := net.ParseIP(h); ip.To4() != nil {
+				h += "/32"
+			} else {
+				h += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(h)
+		if err != nil {
+			common.Log.Error("invalid host", "host", h, "err", err)
+			continue
+		}
+		rv = append(rv, ipnet)
+	}
+	return rv
+}
+
+func hostsContain(hosts []*net.IPNet, ip net.IP) bool {
+	for _, n := range hosts {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *peer) pathID() string {
+	if p.Info.PathID != "" {
+		return p.Info.PathID
+	}
+	host, _, err := net.SplitHostPort(p.Info.Addr)
+	if err != nil {
+		return p.Info.Addr
+	}
+	return host
+}
+
+// backlog is a persistent queue of message ids: <db>.feed.<peer> holds the
+// ids, <db>.feed.<peer>.pos the offset of the first undelivered one. Both
+// are truncated once everything has been delivered. The position is saved
+// every backlogSaveInterval while delivering, after a crash the articles
+// since are offered again and refused by the peer as duplicates.
+type backlog struct {
+	mu    sync.Mutex
+	f     *os.File
+	pos   int64
+	saved time.Time
+}
+
+func openBacklog(path string) (*backlog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0777)
+	if err != nil {
+		return nil, err
+	}
+	b := &backlog{f: f}
+	if buf, err := ioutil.ReadFile(path + ".pos"); err == nil {
+		b.pos, _ = strconv.ParseInt(string(bytes.TrimSpace(buf)), 10, 64)
+	}
+	if b.size() < 0 {
+		// Crashed between truncating the backlog and its position
+		b.pos = 0
+	}
+	return b, nil
+}
+
+func (b *backlog) push(msgID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.f.Seek(0, 2); err != nil {
+		return err
+	}
+	_, err := b.f.WriteString(msgID + "\n")
+	return err
+}
+
+// peek returns the undelivered message id skip bytes past the first one
+// and the length of its line, or io.EOF when there is none.
+func (b *backlog) peek(skip int64) (string, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	buf := make([]byte, 512)
+	n, err := b.f.ReadAt(buf, b.pos+skip)
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return "", 0, err
+	}
+	idx := bytes.IndexByte(buf[:n], '\n')
+	if idx == -1 {
+		// Torn or overlong line, skip what we have
+		return "", int64(n), nil
+	}
+	return string(buf[:idx]), int64(idx + 1), nil
+}
+
+func (b *backlog) advance(n int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pos += n
+
+	st, err := b.f.Stat()
+	if err != nil {
+		return err
+	}
+	if b.pos >= st.Size() {
+		b.pos = 0
+		if err := b.f.Truncate(0); err != nil {
+			return err
+		}
+	} else if time.Since(b.saved) < backlogSaveInterval {
+		return nil
+	}
+	return b.savePos()
+}
+
+// flush saves the position of the backlog.
+func (b *backlog) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.savePos()
+}
+
+func (b *backlog) savePos() error {
+	pf, err := os.OpenFile(b.f.Name()+".pos", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+	if _, err = pf.WriteString(strconv.FormatInt(b.pos, 10)); err == nil {
+		b.saved = time.Now()
+	}
+	return err
+}
+
+func (b *backlog) size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, err := b.f.Stat()
+	if err != nil {
+		return 0
+	}
+	return st.Size() - b.pos
+}
+
+// setPeer adds, updates or removes (Deleted) a peer, replaying F records.
+func (db *Backend) setPeer(info *common.PeerInfo) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if info.Deleted {
+		db.log.Debug("remove peer", "peer", info.Name)
+		delete(db.Peers, info.Name)
+		return
+	}
+	if p := db.Peers[info.Name]; p != nil {
+		db.log.Debug("update peer", "peer", info.Name, "addr", info.Addr)
+		p.setInfo(info)
+		return
+	}
+	db.log.Debug("add peer", "peer", info.Name, "addr", info.Addr)
+	db.Peers[info.Name] = newPeer(info)
+}
+
+// trustedPeer reports whether a transferred article comes from a peer,
+// either by its address or by the login of the session.
+func (db *Backend) trustedPeer(article *enn.Article, ip net.IP) bool {
+	return article.Transfer && db.isPeer(ip)
+}
+
+// AllowTransfer lets only peers transfer articles with IHAVE and TAKETHIS,
+// which skip injection.
+func (db *Backend) AllowTransfer() bool {
+	return db.isPeer(db.remoteIP)
+}
+
+// isPeer reports whether the session is one of a peer, logged in or
+// connecting from ip.
+func (db *Backend) isPeer(ip net.IP) bool {
+	if db.trusted {
+		return true
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, p := range db.Peers {
+		if p.allows(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitExempt reports whether ip is exempt from the connection limits,
+// being in Config.ExemptHosts or the address of a peer.
+func (db *Backend) LimitExempt(ip net.IP) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if hostsContain(db.exemptHosts, ip) {
+		return true
+	}
+	for _, p := range db.Peers {
+		if p.allows(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerLogin reports whether user and pass are the login of a peer.
+func (db *Backend) peerLogin(user, pass string) bool {
+	var hashes []string
+	db.mu.RLock()
+	for _, p := range db.Peers {
+		if p.Info.User != "" && p.Info.User == user {
+			hashes = append(hashes, p.Info.Password)
+		}
+	}
+	db.mu.RUnlock()
+	for _, h := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(h), []byte(pass)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// migratePeers hashes the plaintext passwords of peers, then blanks out
+// the F records having them at offsets.
+func (db *Backend) migratePeers(offsets [][2]int64) error {
+	for _, p := range db.Peers {
+		if p.Info.Password == "" || isPasswordHash(p.Info.Password) {
+			continue
+		}
+		info := *p.Info
+		hash, err := hashPassword(info.Password)
+		if err != nil {
+			return err
+		}
+		info.Password = hash
+		if err := db.writePeer(&info); err != nil {
+			return err
+		}
+		p.setInfo(&info)
+		db.log.Info("hashed peer password", "peer", info.Name)
+	}
+	return db.blankLines(offsets)
+}
+
+func (db *Backend) writePeer(info *common.PeerInfo) error {
+	buf := bytes.NewBufferString("\nF")
+	json.NewEncoder(buf).Encode(info)
+	return db.writeIndex(buf.Bytes())
+}
+
+// openBacklogs opens the backlog of every configured peer and removes
+// those of deleted peers.
+func (db *Backend) openBacklogs(path string) error {
+	names, err := filepath.Glob(path + ".feed.*")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		peer := strings.TrimSuffix(strings.TrimPrefix(name, path+".feed."), ".pos")
+		if db.Peers[peer] == nil {
+			db.log.Info("feed: backlog of deleted peer removed", "peer", peer, "file", name)
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, p := range db.Peers {
+		b, err := openBacklog(path + ".feed." + name)
+		if err != nil {
+			return err
+		}
+		p.backlog = b
+	}
+	return nil
+}
+
+// enqueue queues a newly stored article for the peers wanting its groups,
+// except those it came from. Groups with a read acl are only fed to the
+// peers it names.
+func (db *Backend) enqueue(a *common.Article, msgID string, targets []*Group) {
+	path := a.Headers.Get("Path")
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, p := range db.Peers {
+		if p.backlog == nil || p.Info.Addr == "" || enn.PathContains(path, p.pathID()) {
+			continue
+		}
+		var groups []string
+		for _, g := range targets {
+			if g.acl.read.listsPeer(p) {
+				groups = append(groups, g.Group.Name)
+			}
+		}
+		if !enn.MatchWildmatAny(p.Info.Groups, groups) {
+			continue
+		}
+		if err := p.backlog.push(msgID); err != nil {
+			db.log.Error("feed: queue", "peer", p.Info.Name, "msgid", msgID, "err", err)
+			continue
+		}
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// StartFeeds starts delivering to every configured peer.
+func (db *Backend) StartFeeds() {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, p := range db.Peers {
+		if p.Info.Addr == "" {
+			continue
+		}
+		db.log.Info("feed", "peer", p.Info.Name, "mode", p.Info.Mode, "addr", p.Info.Addr,
+			"groups", p.Info.Groups, "backlog", p.backlog.size())
+		go db.feed(p)
+	}
+}
+
+func (db *Backend) feed(p *peer) {
+	backoff := feedMinBackoff
+	for {
+		if err := db.feedOnce(p); err != nil {
+			db.log.Error("feed failed", "peer", p.Info.Name, "err", err, "retry", backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > feedMaxBackoff {
+				backoff = feedMaxBackoff
+			}
+			continue
+		}
+		backoff = feedMinBackoff
+		select {
+		case <-p.wake:
+		case <-time.After(feedMaxBackoff):
+		}
+	}
+}
+
+// feedOnce delivers the backlog of p over one connection. It returns nil
+// once the backlog is empty and an error when it should be retried later.
+func (db *Backend) feedOnce(p *peer) error {
+	if p.backlog.size() == 0 {
+		return nil
+	}
+
+	c, err := enn.Dial(p.Info.Addr, feedTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Quit()
+	defer p.backlog.flush()
+
+	stream := p.Info.Mode == "stream"
+	if stream {
+		if err := c.ModeStream(); err != nil {
+			db.log.Info("feed: streaming refused, using IHAVE", "peer", p.Info.Name, "err", err)
+			stream = false
+		}
+	}
+
+	var sent int
+	if stream {
+		sent, err = db.feedStream(c, p)
+	} else {
+		sent, err = db.feedIHave(c, p)
+	}
+	if sent > 0 {
+		db.log.Debug("feed: sent", "peer", p.Info.Name, "articles", sent)
+	}
+	return err
+}
+
+// feedIHave offers the backlog of p one article at a time with IHAVE.
+func (db *Backend) feedIHave(c *enn.Client, p *peer) (sent int, err error) {
+	for {
+		msgID, n, err := p.backlog.peek(0)
+		if err == io.EOF {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+
+		if a := db.feedArticle(msgID); a != nil {
+			ok, err := db.delivered(msgID, c.IHave(a))
+			if err != nil {
+				return sent, err
+			}
+			if ok {
+				sent++
+			}
+		}
+		if err := p.backlog.advance(n); err != nil {
+			return sent, err
+		}
+	}
+}
+
+// feedStream streams the backlog of p, keeping up to streamWindow CHECK
+// and TAKETHIS commands in flight. The backlog advances past articles as
+// soon as they and all before them are done with.
+func (db *Backend) feedStream(c *enn.Client, p *peer) (sent int, err error) {
+	type entry struct {
+		msgID string
+		n     int64
+		done  bool
+	}
+	// Undelivered entries in backlog order, and those awaiting an answer
+	// in the order of their commands
+	var entries, inflight []*entry
+	var ahead int64
+	for eof := false; ; {
+		for !eof && len(inflight) < streamWindow {
+			msgID, n, err := p.backlog.peek(ahead)
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return sent, err
+			}
+			ahead += n
+			e := &entry{msgID: msgID, n: n}
+			entries = append(entries, e)
+			if _, ok := db.internalGetArticle(msgID); msgID == "" || !ok {
+				// Cancelled or expired meanwhile
+				e.done = true
+				continue
+			}
+			if err := c.SendCheck(msgID); err != nil {
+				return sent, err
+			}
+			inflight = append(inflight, e)
+		}
+
+		for len(entries) > 0 && entries[0].done {
+			if err := p.backlog.advance(entries[0].n); err != nil {
+				return sent, err
+			}
+			ahead -= entries[0].n
+			entries = entries[1:]
+		}
+		if len(inflight) == 0 {
+			return sent, nil
+		}
+
+		code, msgID, err := c.StreamResponse()
+		if err != nil {
+			return sent, err
+		}
+		e := inflight[0]
+		inflight = inflight[1:]
+		if msgID != e.msgID {
+			return sent, fmt.Errorf("answer about %s, wanted %s", msgID, e.msgID)
+		}
+		switch code {
+		case 238:
+			if a := db.feedArticle(e.msgID); a == nil {
+				e.done = true
+			} else if err := c.SendTakeThis(a); err != nil {
+				return sent, err
+			} else {
+				inflight = append(inflight, e)
+			}
+		case 239:
+			sent++
+			e.done = true
+		case 438, 439:
+			db.log.Debug("feed: refused", "msgid", e.msgID, "code", code)
+			e.done = true
+		default:
+			// 431 and failures are tried again later
+			return sent, &enn.NNTPError{Code: code, Msg: e.msgID}
+		}
+	}
+}
+
+// feedArticle loads an article to feed, nil when it is gone.
+func (db *Backend) feedArticle(msgID string) *enn.Article {
+	ar, ok := db.internalGetArticle(msgID)
+	if !ok {
+		// Cancelled or expired meanwhile
+		return nil
+	}
+	a, err := db.mkArticle(ar, false, nil)
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+// delivered sorts the result of a transfer: false when the peer did not
+// want the article or rejected it, both of which are final, and an error
+// when the transfer should be retried.
+func (db *Backend) delivered(msgID string, err error) (bool, error) {
+	if e, ok := err.(*enn.NNTPError); ok {
+		switch e.Code {
+		case 435, 437, 438, 439:
+			db.log.Debug("feed: refused", "msgid", msgID, "err", e)
+			return false, nil
+		}
+	}
+	return err == nil, err
+}
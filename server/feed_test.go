@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coyove/enn"
+)
+
+// openTestDB loads the index at path, created with the given records when
+// missing, as a server named name.
+func openTestDB(t *testing.T, path, name string, records ...string) *Backend {
+	t.Helper()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(path, []byte("\n"+strings.Join(records, "\n")+"\n"), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*ServerName = name
+	db := &Backend{}
+	if err := LoadIndex(path, db, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeTestDB(db) })
+	return db
+}
+
+// closeTestDB closes the files of db, as stopping the server would.
+func closeTestDB(db *Backend) {
+	db.Index.Close()
+	for _, f := range db.Data.Files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	for _, p := range db.Peers {
+		if p.backlog != nil {
+			p.backlog.f.Close()
+		}
+	}
+}
+
+// serveTestDB serves db over NNTP on a local port, returning its address.
+func serveTestDB(t *testing.T, db *Backend) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := enn.NewServer(db)
+	s.ThrotCmdWindow = time.Second * time.Duration(db.Config.ThrotCmdWin)
+	s.LimitExempt = db.LimitExempt
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.Process(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// postTestArticle posts an article as an anonymous client, each from its
+// own address so the post cooldown does not apply.
+func postTestArticle(t *testing.T, db *Backend, group, msgID string, n int) {
+	t.Helper()
+	postTestBody(t, db, group, msgID, fmt.Sprintf("body of %s\r\n", msgID), n, nil)
+}
+
+// postTestBody posts an article with body and extra headers from the
+// address 127.0.1.n.
+func postTestBody(t *testing.T, db *Backend, group, msgID, body string, n int, extra textproto.MIMEHeader) {
+	t.Helper()
+	h := textproto.MIMEHeader{}
+	h.Set("From", "poster <poster@example.com>")
+	h.Set("Newsgroups", group)
+	h.Set("Subject", "test "+msgID)
+	h.Set("Message-Id", msgID)
+	for k, v := range extra {
+		h[k] = v
+	}
+	err := db.Post(&enn.Article{
+		Header:     h,
+		Body:       strings.NewReader(body),
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 1, byte(n))},
+	})
+	if err != nil {
+		t.Fatalf("post %s: %v", msgID, err)
+	}
+}
+
+// waitArticles waits for db to have all the articles of msgIDs.
+func waitArticles(t *testing.T, db *Backend, msgIDs []string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for _, id := range msgIDs {
+		for {
+			if _, ok := db.internalGetArticle(id); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not fed", id)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestFeed(t *testing.T) {
+	for _, mode := range []string{"ihave", "stream"} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			group := `G{"Name":"test.feed","MaxLives":100}`
+
+			b := openTestDB(t, filepath.Join(dir, "b"), "b.example", group,
+				`F{"Name":"a","Groups":"*","Hosts":"127.0.0.1"}`)
+			addr := serveTestDB(t, b)
+
+			apath := filepath.Join(dir, "a")
+			a := openTestDB(t, apath, "a.example", group,
+				fmt.Sprintf(`F{"Name":"b","Addr":%q,"Groups":"test.*","Mode":%q,"PathID":"b.example"}`, addr, mode),
+				`F{"Name":"gone","Addr":"127.0.0.1:1","Groups":"*"}`,
+				`F{"Name":"gone","Groups":"*","Deleted":true}`)
+
+			// Queued before the feeds start, they have to survive a restart.
+			// b has one of them already.
+			var ids []string
+			for i := 0; i < 12; i++ {
+				ids = append(ids, fmt.Sprintf("<%s%d@feed.test>", mode, i))
+				postTestArticle(t, a, "test.feed", ids[i], i)
+			}
+			postTestArticle(t, b, "test.feed", ids[5], 50)
+			if n := a.Peers["b"].backlog.size(); n == 0 {
+				t.Fatal("nothing queued")
+			}
+			for _, name := range []string{".feed.gone", ".feed.gone.pos"} {
+				ioutil.WriteFile(apath+name, []byte("<x@feed.test>\n"), 0777)
+			}
+
+			closeTestDB(a)
+			a = openTestDB(t, apath, "a.example")
+			for _, name := range []string{".feed.gone", ".feed.gone.pos"} {
+				if _, err := os.Stat(apath + name); !os.IsNotExist(err) {
+					t.Fatalf("backlog %s of deleted peer kept: %v", name, err)
+				}
+			}
+
+			a.StartFeeds()
+			waitArticles(t, b, ids)
+			for deadline := time.Now().Add(10 * time.Second); a.Peers["b"].backlog.size() > 0; {
+				if time.Now().After(deadline) {
+					t.Fatalf("backlog left: %d bytes", a.Peers["b"].backlog.size())
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			// New articles are fed as they come
+			id := fmt.Sprintf("<%s-live@feed.test>", mode)
+			postTestArticle(t, a, "test.feed", id, 9)
+			waitArticles(t, b, []string{id})
+
+			art, err := b.GetArticle(nil, id, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path := art.Header.Get("Path"); !strings.HasPrefix(path, "b.example!a.example") {
+				t.Fatalf("bad Path %q", path)
+			}
+		})
+	}
+}
+
+func TestFeedPrivateGroups(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "idx"), "a.example",
+		`G{"Name":"test.public","MaxLives":100}`,
+		`G{"Name":"test.mods","MaxLives":100,"Read":"@mod,127.0.0.1"}`,
+		`G{"Name":"test.shared","MaxLives":100,"Read":"@mod,b"}`,
+		`F{"Name":"b","Addr":"127.0.0.1:1","Groups":"*"}`,
+		`F{"Name":"c","Addr":"127.0.0.1:1","Groups":"*"}`)
+	for i, g := range []string{"test.public", "test.mods", "test.shared"} {
+		postTestArticle(t, db, g, "<"+g+"@feed.test>", i)
+	}
+
+	for name, want := range map[string][]string{
+		"b": {"<test.public@feed.test>", "<test.shared@feed.test>"},
+		"c": {"<test.public@feed.test>"},
+	} {
+		var got []string
+		for skip := int64(0); ; {
+			id, n, err := db.Peers[name].backlog.peek(skip)
+			if err != nil {
+				break
+			}
+			got, skip = append(got, id), skip+n
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("%s queued %v", name, got)
+		}
+	}
+}
+
+func TestPeerPasswordMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idx")
+	db := openTestDB(t, path, "a.example", `F{"Name":"b","Groups":"*","User":"feeder","Password":"plain secret"}`)
+
+	if !isPasswordHash(db.Peers["b"].Info.Password) {
+		t.Fatal("password not hashed")
+	}
+	if !db.peerLogin("feeder", "plain secret") || db.peerLogin("feeder", "wrong") {
+		t.Fatal("bad peer login")
+	}
+	buf, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(buf), "plain secret") {
+		t.Fatalf("plaintext password kept in the index:\n%s", buf)
+	}
+
+	closeTestDB(db)
+	db = openTestDB(t, path, "a.example")
+	if !db.peerLogin("feeder", "plain secret") {
+		t.Fatal("bad peer login after reload")
+	}
+}
+
+func TestTransferNeedsPeer(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "idx"), "b.example", `G{"Name":"test.feed","MaxLives":100}`,
+		`F{"Name":"a","Groups":"*","Hosts":"10.0.0.1"}`)
+	c, err := enn.Dial(serveTestDB(t, db), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Quit()
+
+	h := textproto.MIMEHeader{}
+	h.Set("From", "poster <poster@example.com>")
+	h.Set("Newsgroups", "test.feed")
+	h.Set("Subject", "forged")
+	h.Set("Message-Id", "<forged@feed.test>")
+	h.Set("Date", "Mon, 02 Jan 2006 15:04:05 -0700")
+	h.Set("Path", "elsewhere!not-for-mail")
+	a := &enn.Article{Header: h, Body: strings.NewReader("body\r\n")}
+	if err := c.IHave(a); err == nil || err.(*enn.NNTPError).Code != 437 {
+		t.Fatalf("IHAVE from a client: %v", err)
+	}
+	if err := c.ModeStream(); err != nil {
+		t.Fatal(err)
+	}
+	a.Body = strings.NewReader("body\r\n")
+	if err := c.TakeThis(a); err == nil || err.(*enn.NNTPError).Code != 439 {
+		t.Fatalf("TAKETHIS from a client: %v", err)
+	}
+	if _, ok := db.internalGetArticle("<forged@feed.test>"); ok {
+		t.Fatal("transfer from a client stored")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/coyove/enn/server/common"
+)
+
+// Fsck checks the index and data files, printing index lines failing their
+// checksum, refs to missing data, torn writes and data failing its length
+// marker or checksum. With repair, torn index and data tails are truncated,
+// bad index lines blanked, bad articles tombstoned and bad pending articles
+// rejected. Bad earlier revisions are only reported. Repairing locks the
+// index, so it fails while the server runs.
+func (db *Backend) Fsck(path string, repair bool) (problems int, err error) {
+	report := func(f string, a ...interface{}) {
+		problems++
+		fmt.Printf(f+"\n", a...)
+	}
+
+	// Torn data tails are reported with the data files below
+	indexEnd := int64(-1)
+	if db.tails != nil && db.tails.index >= 0 {
+		indexEnd = db.tails.index
+		report("index: torn write after %d", indexEnd)
+	}
+	if repair {
+		if err := lockIndex(db.Index); err != nil {
+			return problems, err
+		}
+		if err := db.trimTails(); err != nil {
+			return problems, err
+		}
+		indexEnd = -1
+	}
+
+	db.mu.RLock()
+	articles := make([]*common.ArticleRef, 0, len(db.Articles))
+	for _, ar := range db.Articles {
+		articles = append(articles, ar)
+	}
+	var pending, revisions []*common.ArticleRef
+	for _, p := range db.PendingArticles {
+		pending = append(pending, p.Ref)
+	}
+	for _, s := range db.Superseded {
+		revisions = append(revisions, s.Ref)
+	}
+	db.mu.RUnlock()
+
+	// Data files are only truncated before the end of what is still read
+	liveEnd := map[int]int64{}
+	check := func(ar *common.ArticleRef) error {
+		err := db.checkRef(ar)
+		if end := ar.Offset + ar.Length; err == nil && end > liveEnd[ar.Index] {
+			liveEnd[ar.Index] = end
+		}
+		return err
+	}
+
+	for _, ar := range articles {
+		if err := check(ar); err != nil {
+			report("article %s: %v", ar.MsgID(), err)
+			if repair {
+				if err := db.DeleteArticle(ar.MsgID()); err != nil {
+					return problems, err
+				}
+			}
+		}
+	}
+	for _, ar := range pending {
+		if err := check(ar); err != nil {
+			report("pending article %s: %v", ar.MsgID(), err)
+			if repair {
+				act := &common.ModAction{Action: "reject", MsgID: ar.MsgID(), By: "fsck",
+					Reason: err.Error(), Time: time.Now().Unix()}
+				if err := db.writeModAction(act); err != nil {
+					return problems, err
+				}
+				db.removePending(ar.RawMsgID)
+			}
+		}
+	}
+	for _, ar := range revisions {
+		if err := check(ar); err != nil {
+			report("earlier revision %s: %v", ar.MsgID(), err)
+		}
+	}
+
+	db.muFile.Lock()
+	data := append([]*os.File{}, db.Data.Files...)
+	db.muFile.Unlock()
+	for i, f := range data {
+		if f == nil {
+			continue
+		}
+		end, err := dataEnd(f)
+		if err != nil {
+			report("%s: %v", f.Name(), err)
+			if end < liveEnd[i] {
+				fmt.Printf("%s: not truncated, articles follow up to %d\n", f.Name(), liveEnd[i])
+			} else if repair {
+				if err := f.Truncate(end); err != nil {
+					return problems, err
+				}
+			}
+		}
+	}
+
+	lines, err := badIndexLines(path, indexEnd)
+	if err != nil {
+		return problems, err
+	}
+	for _, ln := range lines {
+		report("index line %d: bad or missing checksum", ln)
+	}
+	if repair && len(lines) > 0 {
+		if err := NopLines(path, lines...); err != nil {
+			return problems, err
+		}
+	}
+	return problems, nil
+}
+
+// checkRef reads the data of ar, checking it against its length marker and
+// checksum.
+func (db *Backend) checkRef(ar *common.ArticleRef) error {
+	f := db.dataFile(ar.Index)
+	if f == nil {
+		return fmt.Errorf("data file %d is missing", ar.Index)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if end := ar.Offset + ar.Length; end > st.Size() {
+		return fmt.Errorf("torn write, ends at %d past the end of %s", end, f.Name())
+	}
+	sum, hasSum, err := readDataHeader(f, ar)
+	if err != nil || !hasSum {
+		return err
+	}
+	buf := make([]byte, ar.Length)
+	if _, err := f.ReadAt(buf, ar.Offset); err != nil {
+		return err
+	}
+	if checksum(buf) != sum {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+// dataEnd walks the records of a data file, returning the end of the last
+// whole one and an error when anything but records follows.
+func dataEnd(f *os.File) (int64, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var hdr [dataHeaderLen]byte
+	for pos := int64(0); pos < st.Size(); {
+		n, err := f.ReadAt(hdr[:], pos)
+		if err != nil && err != io.EOF {
+			return pos, err
+		}
+		var size int64
+		switch {
+		case n >= oldDataHeaderLen && string(hdr[:8]) == dataSep:
+			size = oldDataHeaderLen + int64(binary.BigEndian.Uint64(hdr[8:]))
+		case n >= dataHeaderLen && string(hdr[:8]) == dataSepCRC:
+			size = dataHeaderLen + int64(binary.BigEndian.Uint64(hdr[12:]))
+		default:
+			return pos, fmt.Errorf("torn or unknown record at %d", pos)
+		}
+		if pos+size > st.Size() {
+			return pos, fmt.Errorf("torn record at %d", pos)
+		}
+		pos += size
+	}
+	return st.Size(), nil
+}
+
+// badIndexLines returns the numbers of the index lines failing their checksum,
+// up to the torn tail starting past end when end is not -1.
+func badIndexLines(path string, end int64) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []int
+	sawSum := false
+	rd := bufio.NewReader(f)
+	for ln, off := 1, int64(0); ; ln++ {
+		line, _ := rd.ReadBytes('\n')
+		if len(line) == 0 || end >= 0 && off > end {
+			break
+		}
+		off += int64(len(line))
+		if line[0] == ' ' {
+			continue
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		_, summed, ok := checkLine(line)
+		if sawSum = sawSum || summed; !ok || !summed && sawSum {
+			lines = append(lines, ln)
+		}
+	}
+	return lines, nil
+}
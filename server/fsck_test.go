@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tearTestDB appends a torn index line and a partial data record to the
+// closed db at path, returning the sizes of both before.
+func tearTestDB(t *testing.T, path string) (index, data int64) {
+	t.Helper()
+	for _, f := range []struct {
+		name string
+		tail string
+		size *int64
+	}{
+		{path, "\nA{\"torn", &index},
+		{path + ".data.0", dataSepCRC + "\x00\x00", &data},
+	} {
+		st, err := os.Stat(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*f.size = st.Size()
+		af, err := os.OpenFile(f.name, os.O_APPEND|os.O_WRONLY, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		af.WriteString(f.tail)
+		af.Close()
+	}
+	return index, data
+}
+
+func checkSizes(t *testing.T, path string, index, data int64) {
+	t.Helper()
+	for name, size := range map[string]int64{path: index, path + ".data.0": data} {
+		if st, err := os.Stat(name); err != nil || st.Size() != size {
+			t.Fatalf("%s: %v, size %d wanted", name, err, size)
+		}
+	}
+}
+
+func TestTornTails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idx")
+	db := openTestDB(t, path, "a.example", fillGroups[0])
+	postTestArticle(t, db, "test.a", "<a0@torn.test>", 0)
+	closeTestDB(db)
+	index, data := tearTestDB(t, path)
+	buf, _ := ioutil.ReadFile(path)
+
+	// Commands leave the tails to the server and refuse to write after them
+	db = &Backend{}
+	if err := LoadIndex(path, db, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.internalGetArticle("<a0@torn.test>"); !ok {
+		t.Fatal("article lost")
+	}
+	if err := db.WriteCommand([]byte("\nB127.0.0.1/32")); err != errTornTails {
+		t.Fatalf("written after the torn tail: %v", err)
+	}
+	if problems, err := db.Fsck(path, false); err != nil || problems != 2 {
+		t.Fatalf("fsck found %d problems: %v", problems, err)
+	}
+	if after, _ := ioutil.ReadFile(path); string(after) != string(buf) {
+		t.Fatal("index changed without repair")
+	}
+
+	if _, err := db.Fsck(path, true); err != nil {
+		t.Fatal(err)
+	}
+	checkSizes(t, path, index, data)
+	if problems, err := db.Fsck(path, false); err != nil || problems != 0 {
+		t.Fatalf("fsck found %d problems after repair: %v", problems, err)
+	}
+	postTestArticle(t, db, "test.a", "<a1@torn.test>", 1)
+	closeTestDB(db)
+
+	// The server trims them on loading
+	index, data = tearTestDB(t, path)
+	db = openTestDB(t, path, "a.example")
+	checkSizes(t, path, index, data)
+	for _, id := range []string{"<a0@torn.test>", "<a1@torn.test>"} {
+		if _, ok := db.internalGetArticle(id); !ok {
+			t.Fatalf("%s lost", id)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/coyove/enn/server/common"
+)
+
+// Data files but the last one with less live bytes than gcLiveRatio of
+// their size are collected by GC.
+const gcLiveRatio = 0.5
+
+// GC copies the articles still referenced from mostly dead data files to
+// the last one, recording each move with an M record, then removes those
+// files. The index is locked first, so this fails while the server runs.
+func (db *Backend) GC() (files, moved int, freed int64, err error) {
+	if err := lockIndex(db.Index); err != nil {
+		return 0, 0, 0, err
+	}
+	// Every ref reading data: articles, pending articles and earlier revisions
+	refs := map[int][]*common.ArticleRef{}
+	live := map[int]int64{}
+	seen := map[[2]int64]bool{}
+	add := func(ar *common.ArticleRef) {
+		if loc := [2]int64{int64(ar.Index), ar.Offset}; !seen[loc] {
+			seen[loc] = true
+			refs[ar.Index] = append(refs[ar.Index], ar)
+			hdr := int64(oldDataHeaderLen)
+			if _, crc, err := readDataHeader(db.Data.Files[ar.Index], ar); err == nil && crc {
+				hdr = dataHeaderLen
+			}
+			live[ar.Index] += hdr + ar.Length
+		}
+	}
+	db.mu.RLock()
+	for _, ar := range db.Articles {
+		add(ar)
+	}
+	for _, p := range db.PendingArticles {
+		add(p.Ref)
+	}
+	for _, s := range db.Superseded {
+		add(s.Ref)
+	}
+	db.mu.RUnlock()
+
+	db.muFile.Lock()
+	data := append([]*os.File{}, db.Data.Files[:len(db.Data.Files)-1]...)
+	db.muFile.Unlock()
+
+	for i, f := range data {
+		if f == nil {
+			continue
+		}
+		st, err := f.Stat()
+		if err != nil {
+			return files, moved, freed, err
+		}
+		if float64(live[i]) >= float64(st.Size())*gcLiveRatio {
+			continue
+		}
+
+		sort.Slice(refs[i], func(a, b int) bool { return refs[i][a].Offset < refs[i][b].Offset })
+		for _, ar := range refs[i] {
+			if err := db.moveData(f, ar); err != nil {
+				return files, moved, freed, fmt.Errorf("move %s: %v", ar.MsgID(), err)
+			}
+			moved++
+		}
+
+		// Nothing refers to f once the moves are on disk
+		db.muFile.Lock()
+		err = db.Index.Sync()
+		for _, df := range db.Data.Files[len(data):] {
+			if err == nil {
+				err = df.Sync()
+			}
+		}
+		if err == nil {
+			db.Data.Files[i] = nil
+		}
+		db.muFile.Unlock()
+		if err != nil {
+			return files, moved, freed, err
+		}
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return files, moved, freed, err
+		}
+		db.log.Info("data file collected", "file", f.Name(), "moved", len(refs[i]), "freed", st.Size()-live[i])
+		files++
+		freed += st.Size() - live[i]
+	}
+	return files, moved, freed, nil
+}
+
+// moveData copies the data of ar from f to the last data file.
+func (db *Backend) moveData(f *os.File, ar *common.ArticleRef) error {
+	sum, hasSum, err := readDataHeader(f, ar)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, ar.Length)
+	if _, err := f.ReadAt(buf, ar.Offset); err != nil {
+		return err
+	}
+	if hasSum && checksum(buf) != sum {
+		return fmt.Errorf("checksum mismatch")
+	}
+
+	nr, err := db.writeData(buf)
+	if err != nil {
+		return err
+	}
+	if err := db.writeIndex([]byte(fmt.Sprintf("\nM%s %d %s %d %s", ar.MsgID(),
+		ar.Index, strconv.FormatInt(ar.Offset, 36),
+		nr.Index, strconv.FormatInt(nr.Offset, 36)))); err != nil {
+		return err
+	}
+	db.relocate(ar.RawMsgID, ar.Index, ar.Offset, nr.Index, nr.Offset)
+	return nil
+}
+
+// relocate points the refs of an article at index/offset to its new place,
+// replaying M records.
+func (db *Backend) relocate(raw [16]byte, index int, offset int64, newIndex int, newOffset int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// Refs are replaced, not changed, sessions may be reading them
+	move := func(ar *common.ArticleRef) *common.ArticleRef {
+		if ar == nil || ar.Index != index || ar.Offset != offset {
+			return ar
+		}
+		nr := *ar
+		nr.Index, nr.Offset = newIndex, newOffset
+		return &nr
+	}
+	if ar := db.Articles[raw]; ar != nil {
+		db.Articles[raw] = move(ar)
+	}
+	if p := db.PendingArticles[raw]; p != nil {
+		p.Ref = move(p.Ref)
+	}
+	if s := db.Superseded[raw]; s != nil {
+		s.Ref = move(s.Ref)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idx")
+	hash, _ := hashPassword("password")
+	db := openTestDB(t, path, "a.example", append(fillGroups,
+		`C{"DataFileSize":6000,"KeepHistory":true}`,
+		`U{"Name":"mod@example.com","Password":"`+hash+`","Role":"mod"}`)...)
+
+	// The first data file ends up with a dead article, a pending one and
+	// an earlier revision
+	postTestBody(t, db, "test.a", "<big@gc.test>", strings.Repeat("dead\r\n", 700), 1, nil)
+	postTestArticle(t, db, "test.m", "<m0@gc.test>", 2)
+	postTestArticle(t, db, "test.a", "<a0@gc.test>", 3)
+	if err := db.DeleteArticle("<big@gc.test>"); err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := db.Authenticate("mod@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postTestBody(t, sess.(*Backend), "test.a", "<a0v2@gc.test>", "second revision\r\n", 4,
+		textproto.MIMEHeader{"Supersedes": {"<a0@gc.test>"}})
+	if len(db.Data.Files) < 2 || len(db.Superseded) != 1 || len(db.PendingArticles) != 1 {
+		t.Fatalf("bad setup: %d data files, %d revisions, %d pending",
+			len(db.Data.Files), len(db.Superseded), len(db.PendingArticles))
+	}
+	want := snapshot(t, db)
+	size := func(f *os.File) int64 {
+		st, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Size()
+	}
+	last := db.Data.Files[len(db.Data.Files)-1]
+	first, lastBefore := size(db.Data.Files[0]), size(last)
+
+	files, moved, freed, err := db.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 1 || moved != 2 {
+		t.Fatalf("collected %d files, moved %d articles", files, moved)
+	}
+	// The moved records, headers included, are what was not freed
+	if kept := size(last) - lastBefore; freed != first-kept {
+		t.Fatalf("freed %d of %d bytes, %d moved", freed, first, kept)
+	}
+	if _, err := os.Stat(path + ".data.0"); !os.IsNotExist(err) {
+		t.Fatalf("data file kept: %v", err)
+	}
+	if got := snapshot(t, db); got != want {
+		t.Fatalf("articles differ after GC:\n%s\n\nwanted:\n%s", got, want)
+	}
+
+	closeTestDB(db)
+	db = openTestDB(t, path, "a.example")
+	if got := snapshot(t, db); got != want {
+		t.Fatalf("articles differ after restart:\n%s\n\nwanted:\n%s", got, want)
+	}
+
+	// Moved pending articles can still be approved
+	if err := db.Moderate("<m0@gc.test>", true, "mod@example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := db.GetArticle(nil, "<m0@gc.test>", false); err != nil || a.Header.Get("Approved") == "" {
+		t.Fatalf("approved article: %v", err)
+	}
+}
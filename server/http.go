@@ -9,6 +9,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coyove/enn"
@@ -18,20 +20,24 @@ import (
 )
 
 var HandleGroups = func() func(w http.ResponseWriter, r *http.Request) {
-	var lastBuffer []byte
+	var lastBuffer atomic.Value
 	var interval = time.Second * 2
-
-	go func() {
-		for {
-			time.Sleep(interval + time.Duration(rand.Intn(500))*time.Millisecond)
-			lastBuffer = generateStatus()
-		}
-	}()
+	var start sync.Once
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Drawn from db, which is only loaded by the time anything is served
+		start.Do(func() {
+			lastBuffer.Store(generateStatus())
+			go func() {
+				for {
+					time.Sleep(interval + time.Duration(rand.Intn(500))*time.Millisecond)
+					lastBuffer.Store(generateStatus())
+				}
+			}()
+		})
 		w.Header().Add("Content-Type", "image/png")
 		w.Header().Add("Cache-Control", "max-age="+strconv.Itoa(int(interval/time.Second)))
-		w.Write(lastBuffer)
+		w.Write(lastBuffer.Load().([]byte))
 	}
 }()
 
@@ -120,7 +126,10 @@ func generateStatus() []byte {
 			return 0
 		}()),
 		common.FormatSize(func() int64 {
-			if fi, _ := db.Data[len(db.Data)-1].Stat(); fi != nil {
+			db.muFile.Lock()
+			f := db.Data.Files[len(db.Data.Files)-1]
+			db.muFile.Unlock()
+			if fi, _ := f.Stat(); fi != nil {
 				return fi.Size()
 			}
 			return 0
@@ -133,10 +142,14 @@ func generateStatus() []byte {
 	))
 
 	tb.Write("Mod:")
-	for k := range db.Mods {
-		tb.Write(" ")
-		tb.Write(k)
+	db.mu.RLock()
+	for k, u := range db.Users {
+		if u.IsMod() && !u.Disabled {
+			tb.Write(" ")
+			tb.Write(k)
+		}
 	}
+	db.mu.RUnlock()
 	tb.Write("\n\n")
 
 	for _, g := range payload {
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/coyove/enn"
+	"github.com/coyove/enn/server/common"
+)
+
+// accountOf returns the account owning a From address.
+func (db *Backend) accountOf(addr string) *common.UserInfo {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, u := range db.Users {
+		if u.Owns(addr) {
+			return u
+		}
+	}
+	return nil
+}
+
+// ownsAddress tells if the session is logged in as the account owning addr.
+// The From of a post is whatever the client says, this is what proves it.
+func (db *Backend) ownsAddress(addr string) bool {
+	if db.AuthObject == nil || addr == "" {
+		return false
+	}
+	if strings.EqualFold(addr, db.AuthObject.User) {
+		return true
+	}
+	u := db.getUser(db.AuthObject.User)
+	return u != nil && u.Owns(addr)
+}
+
+// selfAddress is the address of the session's identity, used in Sender.
+func (db *Backend) selfAddress() string {
+	if strings.Contains(db.AuthObject.User, "@") {
+		return db.AuthObject.User
+	}
+	return db.AuthObject.User + "@" + db.ServerName
+}
+
+// checkFrom binds the From of a posted article to its poster:
+//   - addresses of accounts can only be used by their owner and mods
+//   - with Config.BindFrom, users having registered addresses can only use
+//     those and their display name, mods and admins anything
+//   - anonymous posts get Config.AnonymousFrom when set
+//   - Sender is set to the poster's address when it is not the From
+func (db *Backend) checkFrom(article *enn.Article) error {
+	h := article.Header
+	if db.AuthObject == nil && db.Config.AnonymousFrom != "" {
+		h.Set("From", db.Config.AnonymousFrom)
+	}
+	addrs, err := mail.ParseAddressList(h.Get("From"))
+	if err != nil {
+		return &enn.NNTPError{Code: 441, Msg: "Invalid From header"}
+	}
+
+	if db.AuthObject == nil {
+		for _, a := range addrs {
+			if db.accountOf(a.Address) != nil {
+				return enn.ErrNotAuthenticated
+			}
+		}
+		return nil
+	}
+
+	me, mod := db.getUser(db.AuthObject.User), db.IsMod()
+	// Only users having registered addresses can be bound to them
+	bound := db.Config.BindFrom && !mod && me != nil && len(me.Emails()) > 0
+	for _, a := range addrs {
+		if strings.EqualFold(a.Address, db.AuthObject.User) || me != nil && me.Owns(a.Address) {
+			if bound && me.DisplayName != "" && a.Name != "" && a.Name != me.DisplayName {
+				return &enn.NNTPError{Code: 441, Msg: "From name must be " + me.DisplayName}
+			}
+			continue
+		}
+		if mod {
+			continue
+		}
+		if db.accountOf(a.Address) != nil {
+			return &enn.NNTPError{Code: 441, Msg: "From address belongs to another user"}
+		}
+		if bound {
+			return &enn.NNTPError{Code: 441, Msg: "From must be one of your addresses"}
+		}
+	}
+
+	if self := db.selfAddress(); len(addrs) != 1 || !strings.EqualFold(addrs[0].Address, self) {
+		h.Set("Sender", self)
+	} else {
+		h.Del("Sender")
+	}
+	return nil
+}
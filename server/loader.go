@@ -3,11 +3,16 @@ package main
 import (
 	"bufio"
 	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/coyove/common/lru"
@@ -15,106 +20,161 @@ import (
 	"github.com/coyove/enn/server/common"
 )
 
-func LoadIndex(path string, db *Backend) error {
+// LoadIndex opens and replays the index at path into db. Torn writes a
+// crash left at the end of the index and the data are only cut off with
+// trim, until then nothing more can be written. trim is for the server,
+// which also locks the index.
+func LoadIndex(path string, db *Backend, trim bool) error {
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0777)
 	if err != nil {
 		return err
 	}
+	if trim {
+		if err := lockIndex(f); err != nil {
+			f.Close()
+			return err
+		}
+	}
 
 	db.Index = f
+	db.log = common.Log
 	db.Groups = map[string]*Group{}
 	db.Articles = map[[16]byte]*common.ArticleRef{}
-	db.Mods = map[string]*common.ModInfo{}
+	db.Users = map[string]*common.UserInfo{}
+	db.Invites = map[string]*common.InviteInfo{}
 	db.Blacklist = map[string]*net.IPNet{}
+	db.Pending = newPendingGroup()
+	db.PendingArticles = map[[16]byte]*pendingArticle{}
+	db.Superseded = map[[16]byte]*supersededArticle{}
+	db.Peers = map[string]*peer{}
+	db.SuckMarks = map[string]int64{}
 	db.ServerName = *ServerName
+	common.ServerName = *ServerName
+	db.Injector = &enn.Injector{ServerName: *ServerName}
 	db.mu = new(sync.RWMutex)
+	db.muPost = new(sync.Mutex)
 	db.muFile = new(sync.Mutex)
+	db.muModerate = new(sync.Mutex)
 	db.ipCache = lru.NewCache(1e3)
 
-	df0, err := os.OpenFile(path+".data.0", os.O_CREATE|os.O_RDWR, 0777)
+	// Data files emptied by GC are removed, leaving gaps in the numbering
+	names, err := filepath.Glob(path + ".data.*")
 	if err != nil {
 		return err
 	}
-	db.Data = []*os.File{df0}
+	last := 0
+	for _, name := range names {
+		if i, err := strconv.Atoi(strings.TrimPrefix(name, path+".data.")); err == nil && i > last {
+			last = i
+		}
+	}
+	db.Data = &DataFiles{Files: make([]*os.File, last+1)}
+	for i := range db.Data.Files {
+		flag := os.O_RDWR
+		if i == last {
+			flag |= os.O_CREATE
+		}
+		df, err := os.OpenFile(path+".data."+strconv.Itoa(i), flag, 0777)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		db.Data.Files[i] = df
+	}
 
-	for i := 1; ; i++ {
-		df, err := os.OpenFile(path+".data."+strconv.Itoa(i), os.O_RDWR, 0777)
+	// A crash may leave partial records at the end of the data and the
+	// index, and index lines whose data never made it to the disk. They
+	// are read up to the last consistent state, with trim also cut back
+	// to it.
+	tails := &tornTails{index: -1}
+	if tails.data, err = db.dataTail(); err != nil {
+		return err
+	}
+	sizes := make([]int64, len(db.Data.Files))
+	for i, df := range db.Data.Files {
+		if df == nil {
+			continue
+		}
+		st, err := df.Stat()
 		if err != nil {
-			break
+			return err
 		}
-		db.Data = append(db.Data, df)
+		sizes[i] = st.Size()
+	}
+	if tails.data >= 0 {
+		sizes[len(sizes)-1] = tails.data
+	}
+	pastEnd := func(index int, offset, length int64) bool {
+		return index >= 0 && index < len(sizes) && db.Data.Files[index] != nil && offset+length > sizes[index]
 	}
+	torn, sawSum := int64(-1), false
 
 	rd := bufio.NewReader(f)
 	invalidGroupsFound := map[string]struct{}{}
+	mods, modOffsets := map[string]*common.ModInfo{}, [][2]int64{}
+	var peerOffsets [][2]int64
 
-	for ln := 1; ; ln++ {
+replay:
+	for ln, off := 1, int64(0); ; ln++ {
 		line, _ := rd.ReadBytes('\n')
 		if len(line) == 0 {
 			break
 		}
+		lineOff := off
+		off += int64(len(line))
 
+		if line[0] == ' ' {
+			// Blanked by NopLines, its checksum no longer matches
+			continue
+		}
 		line = bytes.TrimSpace(line)
 		if len(line) == 0 {
 			continue
 		}
+		line, summed, ok := checkLine(line)
+		// Every line after the first one having a checksum has one too
+		sawSum = sawSum || summed
+		ok = ok && (summed || !sawSum)
+		if _, err := rd.Peek(1); !ok && err != nil {
+			torn = lineOff
+			break
+		}
+		if !ok {
+			db.log.Error("index line checksum mismatch", "line", ln, "text", string(line))
+			continue
+		}
 
 		switch line[0] {
 		case ' ': // nop
 		case 'G':
 			if len(line) < 3 {
-				common.E("#%d %q invalid G header", ln, line)
+				db.log.Error("invalid G record", "line", ln, "text", string(line))
 				continue
 			}
 			baseInfo := &common.BaseGroupInfo{}
 			if err := json.Unmarshal(line[1:], baseInfo); err != nil {
-				common.E("#%d %q invalid G header, json: %v", ln, line, err)
+				db.log.Error("invalid G record", "line", ln, "text", string(line), "reason", "json", "err", err)
 				continue
 			}
 			if baseInfo.Name == "" {
-				common.E("#%d %q invalid G header, empty group name", ln, line)
+				db.log.Error("invalid G record", "line", ln, "text", string(line), "reason", "empty group name")
 				continue
 			}
-			gs := &Group{
-				Group: &enn.Group{
-					Name:        baseInfo.Name,
-					Description: baseInfo.Desc,
-				},
-				Articles: &common.HighLowSlice{
-					MaxSize: int(baseInfo.MaxLives),
-				},
-				BaseInfo:      baseInfo,
-				NoPurgeNotify: true,
-			}
-			switch baseInfo.Posting {
-			case 0:
-				gs.Group.Posting = enn.PostingPermitted
-			case 1:
-				gs.Group.Posting = enn.PostingNotPermitted
-			case 2:
-				gs.Group.Posting = enn.PostingModerated
-			default:
-				common.E("#%d %q invalid G header, invalid posting status", ln, line)
+			if err := db.setGroup(baseInfo, true); err != nil {
+				db.log.Error("invalid G record", "line", ln, "text", string(line), "err", err)
 				continue
 			}
-			if old := db.Groups[baseInfo.Name]; old != nil {
-				common.D("#%d update group: %s => %s", ln, baseInfo.Name, baseInfo.Diff(old.BaseInfo))
-				old.Group = gs.Group
-				old.BaseInfo = gs.BaseInfo
-				old.Articles.MaxSize = int(baseInfo.MaxLives)
-			} else {
-				common.D("#%d create group: %s", ln, baseInfo.Name)
-				db.Groups[baseInfo.Name] = gs
-			}
 		case 'A':
 			if len(line) < 10 { // format: "Agroup msgid index offset length", 10 chars minimal
-				common.E("#%d %q invalid A header", ln, line)
+				db.log.Error("invalid A record", "line", ln, "text", string(line))
 				continue
 			}
 
 			parts := bytes.Split(line[1:], []byte(" "))
 			if len(parts) != 5 {
-				common.E("#%d %q invalid A header, need 5 arguments", ln, line)
+				db.log.Error("invalid A record", "line", ln, "text", string(line), "reason", "need 5 arguments")
 				continue
 			}
 			group, msgid, indexbuf, offsetbuf, lengthbuf := parts[0], parts[1], parts[2], parts[3], parts[4]
@@ -129,68 +189,236 @@ func LoadIndex(path string, db *Backend) error {
 
 			ar.Index, err = strconv.Atoi(string(indexbuf))
 			if err != nil {
-				common.E("#%d %q invalid A header, invalid index: %v", ln, line, err)
+				db.log.Error("invalid A record", "line", ln, "text", string(line), "reason", "invalid index", "err", err)
 				continue
 			}
 
 			ar.Offset, err = strconv.ParseInt(string(offsetbuf), 36, 64)
 			if err != nil {
-				common.E("#%d %q invalid A header, invalid offset: %v", ln, line, err)
+				db.log.Error("invalid A record", "line", ln, "text", string(line), "reason", "invalid offset", "err", err)
 				continue
 			}
 
 			ar.Length, err = strconv.ParseInt(string(lengthbuf), 36, 64)
 			if err != nil {
-				common.E("#%d %q invalid A header, invalid length: %v", ln, line, err)
+				db.log.Error("invalid A record", "line", ln, "text", string(line), "reason", "invalid length", "err", err)
 				continue
 			}
 
-			ar.RawMsgID = common.MsgIDToRawMsgID("", msgid)
+			ar.SetMsgID(string(msgid))
+			if pastEnd(ar.Index, ar.Offset, ar.Length) {
+				torn = lineOff
+				break replay
+			}
 			g.Append(db, ar)
 			db.Articles[ar.RawMsgID] = ar
+		case 'N':
+			// Written by Compact, the next article of the group is numbered n+1
+			parts := bytes.Split(line[1:], []byte(" "))
+			if len(parts) != 2 {
+				db.log.Error("invalid N record", "line", ln, "text", string(line), "reason", "need 2 arguments")
+				continue
+			}
+			n, err := strconv.Atoi(string(parts[1]))
+			if err != nil {
+				db.log.Error("invalid N record", "line", ln, "text", string(line), "reason", "invalid number", "err", err)
+				continue
+			}
+			if name := string(parts[0]); name == PendingGroup {
+				db.Pending.Articles.Skip(n)
+				db.updatePendingGroup()
+			} else if g := db.Groups[name]; g != nil {
+				g.Articles.Skip(n)
+			} else {
+				invalidGroupsFound[name] = struct{}{}
+			}
+		case 'M':
+			// Written by GC, format: "Mmsgid index offset newindex newoffset"
+			parts := bytes.Split(line[1:], []byte(" "))
+			if len(parts) != 5 {
+				db.log.Error("invalid M record", "line", ln, "text", string(line), "reason", "need 5 arguments")
+				continue
+			}
+			var loc [4]int64
+			for i, p := range parts[1:] {
+				base := 10
+				if i%2 == 1 {
+					base = 36
+				}
+				if loc[i], err = strconv.ParseInt(string(p), base, 64); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				db.log.Error("invalid M record", "line", ln, "text", string(line), "err", err)
+				continue
+			}
+			raw := common.MsgIDToRawMsgID(string(parts[0]), nil)
+			if ar := db.Articles[raw]; ar != nil && pastEnd(int(loc[2]), loc[3], ar.Length) {
+				torn = lineOff
+				break replay
+			}
+			db.relocate(raw, int(loc[0]), loc[1], int(loc[2]), loc[3])
 		case 'D':
 			msgid := line[1:]
 			delete(db.Articles, common.MsgIDToRawMsgID("", msgid))
+		case 'P':
+			parts := bytes.Split(line[1:], []byte(" "))
+			if len(parts) != 5 {
+				db.log.Error("invalid P record", "line", ln, "text", string(line), "reason", "need 5 arguments")
+				continue
+			}
+			ar := &common.ArticleRef{}
+			ar.SetMsgID(string(parts[0]))
+			ar.Index, err = strconv.Atoi(string(parts[1]))
+			if err != nil {
+				db.log.Error("invalid P record", "line", ln, "text", string(line), "reason", "invalid index", "err", err)
+				continue
+			}
+			ar.Offset, err = strconv.ParseInt(string(parts[2]), 36, 64)
+			if err != nil {
+				db.log.Error("invalid P record", "line", ln, "text", string(line), "reason", "invalid offset", "err", err)
+				continue
+			}
+			ar.Length, err = strconv.ParseInt(string(parts[3]), 36, 64)
+			if err != nil {
+				db.log.Error("invalid P record", "line", ln, "text", string(line), "reason", "invalid length", "err", err)
+				continue
+			}
+			if pastEnd(ar.Index, ar.Offset, ar.Length) {
+				torn = lineOff
+				break replay
+			}
+			db.addPending(ar, strings.Split(string(parts[4]), ","))
+		case 'R':
+			act := &common.ModAction{}
+			if err := json.Unmarshal(line[1:], act); err != nil {
+				db.log.Error("invalid R record", "line", ln, "text", string(line), "err", err)
+				continue
+			}
+			switch act.Action {
+			case "approve", "reject":
+				db.log.Debug("moderation", "line", ln, "action", act)
+				db.removePending(common.MsgIDToRawMsgID(act.MsgID, nil))
+			case "supersede":
+				if len(act.Ref) == 3 {
+					ar := &common.ArticleRef{
+						Index:  int(act.Ref[0]),
+						Offset: act.Ref[1],
+						Length: act.Ref[2],
+					}
+					ar.SetMsgID(act.MsgID)
+					db.addSuperseded(ar, act.Target, act.Time)
+				}
+			}
 		case 'm':
+			// Legacy mod, the whole line is blanked out by migrateMods
+			modOffsets = append(modOffsets, [2]int64{lineOff, off - lineOff - 1})
 			mi := &common.ModInfo{}
 			if err := json.Unmarshal(line[1:], mi); err != nil {
-				common.E("#%d %q invalid mod info: %v", ln, line, err)
+				db.log.Error("invalid m record", "line", ln, "err", err)
 				continue
 			}
-			if db.Mods[mi.Email] == nil {
-				common.D("#%d load mod info: %v", ln, mi)
-				db.Mods[mi.Email] = mi
+			if mods[mi.Email] == nil {
+				mods[mi.Email] = mi
 			} else {
-				common.D("#%d remove mod info: %q", ln, mi)
-				delete(db.Mods, mi.Email)
+				delete(mods, mi.Email)
+			}
+		case 'I':
+			inv := &common.InviteInfo{}
+			if err := json.Unmarshal(line[1:], inv); err != nil {
+				db.log.Error("invalid I record", "line", ln, "text", string(line), "err", err)
+				continue
 			}
+			db.setInvite(inv)
+		case 'U':
+			u := &common.UserInfo{}
+			if err := json.Unmarshal(line[1:], u); err != nil {
+				db.log.Error("invalid U record", "line", ln, "text", string(line), "err", err)
+				continue
+			}
+			db.setUser(u)
+		case 'L':
+			parts := bytes.SplitN(line[1:], []byte(" "), 2)
+			if len(parts) != 2 {
+				db.log.Error("invalid L record", "line", ln, "text", string(line), "reason", "need 2 arguments")
+				continue
+			}
+			t, err := strconv.ParseInt(string(parts[0]), 10, 64)
+			if err != nil {
+				db.log.Error("invalid L record", "line", ln, "text", string(line), "reason", "invalid time", "err", err)
+				continue
+			}
+			db.setLastLogin(string(parts[1]), t)
 		case 'B':
 			parts := bytes.Split(line[1:], []byte(" "))
 			if len(parts) != 2 {
-				common.E("#%d %q invalid B header, need 2 arguments", ln, line)
+				db.log.Error("invalid B record", "line", ln, "text", string(line), "reason", "need 2 arguments")
 				continue
 			}
 			name, ipnetbuf := string(parts[0]), string(parts[1])
 			_, ipnet, err := net.ParseCIDR(ipnetbuf)
 			if err != nil {
-				common.E("#%d %q invalid B header, invalid CIDR: %v", ln, line, err)
+				db.log.Error("invalid B record", "line", ln, "text", string(line), "reason", "invalid CIDR", "err", err)
 				continue
 			}
 			if db.Blacklist[name] == nil {
-				common.D("#%d add to blacklist: %q => %v", ln, name, ipnet)
+				db.log.Debug("add to blacklist", "line", ln, "name", name, "net", ipnet)
 				db.Blacklist[name] = ipnet
 			} else {
-				common.D("#%d delete from blacklist: %q", ln, name)
+				db.log.Debug("delete from blacklist", "line", ln, "name", name)
 				delete(db.Blacklist, name)
 			}
+		case 'F':
+			pi := &common.PeerInfo{}
+			if err := json.Unmarshal(line[1:], pi); err != nil || pi.Name == "" {
+				db.log.Error("invalid F record", "line", ln, "text", string(line), "err", err)
+				continue
+			}
+			if pi.Password != "" && !isPasswordHash(pi.Password) {
+				// Plaintext password, the line is blanked out by migratePeers
+				peerOffsets = append(peerOffsets, [2]int64{lineOff, off - lineOff - 1})
+			}
+			db.setPeer(pi)
+		case 'S':
+			parts := bytes.Split(line[1:], []byte(" "))
+			if len(parts) != 3 {
+				db.log.Error("invalid S record", "line", ln, "text", string(line), "reason", "need 3 arguments")
+				continue
+			}
+			high, err := strconv.ParseInt(string(parts[2]), 10, 64)
+			if err != nil {
+				db.log.Error("invalid S record", "line", ln, "text", string(line), "reason", "invalid mark", "err", err)
+				continue
+			}
+			db.SuckMarks[string(parts[0])+" "+string(parts[1])] = high
 		case 'C':
 			if err := json.Unmarshal(line[1:], &db.Config); err != nil {
-				common.E("#%d %q invalid C header: %v", ln, line, err)
+				db.log.Error("invalid C record", "line", ln, "text", string(line), "err", err)
 				continue
 			}
 		}
 	}
 
+	if torn >= 0 {
+		// Lines start with a newline, the one before the torn line goes too
+		if torn > 0 {
+			torn--
+		}
+		tails.index = torn
+	}
+	if tails.index >= 0 || tails.data >= 0 {
+		db.tails = tails
+		if !trim {
+			db.log.Error("torn writes left in place", "index", tails.index, "data", tails.data)
+		}
+	}
+	if trim {
+		if err := db.trimTails(); err != nil {
+			return err
+		}
+	}
+
 	// Finishing up
 	for _, g := range db.Groups {
 		g.Group.Count = int64(g.Articles.Len())
@@ -199,20 +427,157 @@ func LoadIndex(path string, db *Backend) error {
 		g.NoPurgeNotify = false
 	}
 
+	db.rawConfig = db.Config
 	db.Config.PostIntervalSec = common.IntIf(db.Config.PostIntervalSec, 30)
 	db.Config.ThrotCmdWin = common.IntIf(db.Config.ThrotCmdWin, 20)
 	db.Config.MaxPostSize = common.IntIf(db.Config.MaxPostSize, 3e6)
+	db.Config.MaxArticleSize = common.IntIf(db.Config.MaxArticleSize, db.Config.MaxPostSize*4/3+headerRoom)
+	for _, n := range []**int64{&db.Config.MaxConnsPerIP, &db.Config.MaxConnsPerUser} {
+		if *n == nil {
+			*n = new(int64)
+			**n = 10
+		}
+	}
+	db.Config.DataFileSize = common.IntIf(db.Config.DataFileSize, 1e9)
+	switch db.Config.Durability {
+	case "none", "batch", "post":
+	default:
+		if db.Config.Durability != "" {
+			db.log.Error("unknown durability, using batch", "durability", db.Config.Durability)
+		}
+		db.Config.Durability = "batch"
+	}
+	db.exemptHosts = parseHosts(db.Config.ExemptHosts)
+	if db.Auth, err = db.newAuthenticator(db.Config.Auth); err != nil {
+		return err
+	}
 
-	common.L("loader: %d data files, %d groups, %d articles, %d mods, %d blocks",
-		len(db.Data), len(db.Groups), len(db.Articles), len(db.Mods), len(db.Blacklist))
-	common.L("loader: %#v", db.Config)
+	// Nothing is written before the tails are trimmed, these wait for the
+	// next load trimming them
+	if db.tails == nil {
+		if err := db.upgradeIndex(mods, modOffsets, peerOffsets); err != nil {
+			return err
+		}
+	}
+
+	if err := db.openBacklogs(path); err != nil {
+		return err
+	}
+
+	db.log.Info("index loaded", "data", len(db.Data.Files), "groups", len(db.Groups), "articles", len(db.Articles),
+		"pending", len(db.PendingArticles), "users", len(db.Users), "blocks", len(db.Blacklist), "peers", len(db.Peers))
+	db.log.Debug("config", "config", db.Config.Redacted())
 
 	if len(invalidGroupsFound) > 0 {
-		common.E("loader: found invalid groups %v", invalidGroupsFound)
+		db.log.Error("articles of unknown groups in index", "groups", fmt.Sprint(invalidGroupsFound))
 	}
 	return nil
 }
 
+// upgradeIndex writes what the loaded index lacks: the Cancel-Lock secret,
+// accounts of legacy mods and hashes of plaintext peer passwords.
+func (db *Backend) upgradeIndex(mods map[string]*common.ModInfo, modOffsets, peerOffsets [][2]int64) error {
+	if db.Config.CancelSecret == "" {
+		// Secret for server side Cancel-Locks, generated once and kept in the index
+		secret := make([]byte, 32)
+		if _, err := crand.Read(secret); err != nil {
+			return err
+		}
+		db.Config.CancelSecret = hex.EncodeToString(secret)
+		db.rawConfig.CancelSecret = db.Config.CancelSecret
+		p := bytes.NewBufferString("\nC")
+		json.NewEncoder(p).Encode(db.rawConfig)
+		if err := db.writeIndex(p.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := db.migrateMods(mods, modOffsets); err != nil {
+		return err
+	}
+	return db.migratePeers(peerOffsets)
+}
+
+// setGroup creates, updates or removes (BaseInfo.Deleted) a group. It is
+// used by the loader replaying G records and by control messages at runtime.
+func (db *Backend) setGroup(baseInfo *common.BaseGroupInfo, loading bool) error {
+	gs := &Group{
+		Group: &enn.Group{
+			Name:        baseInfo.Name,
+			Description: baseInfo.Desc,
+		},
+		Articles: &common.HighLowSlice{
+			MaxSize: int(baseInfo.MaxLives),
+		},
+		BaseInfo:      baseInfo,
+		NoPurgeNotify: loading,
+		acl:           parseGroupACL(baseInfo),
+	}
+	switch baseInfo.Posting {
+	case 0:
+		gs.Group.Posting = enn.PostingPermitted
+	case 1:
+		gs.Group.Posting = enn.PostingNotPermitted
+	case 2:
+		gs.Group.Posting = enn.PostingModerated
+	default:
+		return fmt.Errorf("invalid posting status")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old := db.Groups[baseInfo.Name]
+	switch {
+	case baseInfo.Deleted:
+		db.log.Debug("remove group", "group", baseInfo.Name)
+		delete(db.Groups, baseInfo.Name)
+		if old != nil {
+			db.dropOrphans(old)
+		}
+	case old != nil:
+		db.log.Debug("update group", "group", baseInfo.Name, "diff", baseInfo.Diff(old.BaseInfo))
+		gs.Group.Count, gs.Group.High, gs.Group.Low = old.Group.Count, old.Group.High, old.Group.Low
+		old.Group = gs.Group
+		old.BaseInfo = gs.BaseInfo
+		old.acl = gs.acl
+		old.Articles.MaxSize = int(baseInfo.MaxLives)
+	default:
+		db.log.Debug("create group", "group", baseInfo.Name)
+		if !loading {
+			gs.Group.Low = 1
+		}
+		db.Groups[baseInfo.Name] = gs
+	}
+	return nil
+}
+
+// dropOrphans removes the articles of the removed group g which are in no
+// other group, so they are not found by message-id anymore. Replaying the
+// G record does the same, no D records are needed.
+func (db *Backend) dropOrphans(g *Group) {
+	refs, _, _ := g.Articles.Slice(0, g.Articles.High(), true)
+	orphans := map[[16]byte]bool{}
+	for _, ar := range refs {
+		if ar != nil {
+			orphans[ar.RawMsgID] = true
+		}
+	}
+	for _, other := range db.Groups {
+		if len(orphans) == 0 {
+			break
+		}
+		refs, _, _ := other.Articles.Slice(0, other.Articles.High(), true)
+		for _, ar := range refs {
+			if ar != nil {
+				delete(orphans, ar.RawMsgID)
+			}
+		}
+	}
+	for raw := range orphans {
+		delete(db.Articles, raw)
+	}
+}
+
 // NopLines search the database and 'nop' the given lines so they will be omitted in any future loadings
 func NopLines(path string, lines ...int) error {
 	f, err := os.OpenFile(path, os.O_RDWR, 0777)
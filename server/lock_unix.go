@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockIndex takes an exclusive lock on the index, held until it is closed.
+// The server takes it when loading and the commands rewriting the files
+// before they start, so these never run at once. Other commands only
+// append records, which the server picks up, and go without.
+func lockIndex(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("%s is in use by another process, is the server running?", f.Name())
+		}
+		return err
+	}
+	return nil
+}
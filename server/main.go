@@ -5,11 +5,13 @@ import (
 	"crypto/x509"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
-	"sync"
 	"time"
 
 	"github.com/coyove/enn"
@@ -23,13 +25,26 @@ var (
 	NopDB      = flag.String("nop", "", "NOP lines")
 	ServerName = flag.String("name", "10.94.86.99", "Server name")
 	Listen     = flag.String("l", ":1119 :1563 :8080", "Listen addresses")
-	Verbosity  = flag.Int("v", 1, "Log verbosity")
+	Verbosity  = flag.Int("v", 1, "Log verbosity (0: debug, 1: info, 2: error)")
+	LogFile    = flag.String("log", "", "Log file, stdout if empty")
+	LogFormat  = flag.String("log-format", "text", "Log format: text or json")
+	LogSize    = flag.Int64("log-size", 100e6, "Rotate the log file beyond this size")
+	LogKeep    = flag.Int("log-keep", 5, "Number of rotated log files kept")
 
 	// Interactive flags
 	GroupCmd     = flag.String("group", "", "")
 	ModCmd       = flag.String("mod", "", "")
+	UserCmd      = flag.String("user", "", "")
+	InviteCmd    = flag.Bool("invite", false, "")
 	BlacklistCmd = flag.Bool("blacklist", false, "")
 	ConfigCmd    = flag.Bool("config", false, "")
+	PendingCmd   = flag.Bool("pending", false, "")
+	HistoryCmd   = flag.String("history", "", "")
+	PeerCmd      = flag.String("peer", "", "")
+	SuckCmd      = flag.Bool("suck", false, "")
+	CompactCmd   = flag.Bool("compact", false, "")
+	GCCmd        = flag.Bool("gc", false, "")
+	FsckCmd      = flag.Bool("fsck", false, "")
 )
 
 var (
@@ -37,59 +52,62 @@ var (
 	startAt                      = time.Now()
 	x509cert                     x509.Certificate
 	plainBind, tlsBind, httpBind string
-	ipDedup                      sync.Map
 )
 
 func main() {
 	rand.Seed(time.Now().Unix())
 	flag.Parse()
-	common.Verbose = *Verbosity
-	common.PanicIf(LoadIndex(*DBPath, db), "load data source %v: %%err", *DBPath)
+	setupLog()
+	// Torn tails are only trimmed by the server and by -fsck repairing,
+	// which lock the index like -compact and -gc do
+	common.PanicIf(LoadIndex(*DBPath, db, !commandGiven()), "load data source %v: %%err", *DBPath)
 
 	if HandleCommand() {
 		return
 	}
 
+	db.StartFeeds()
+	db.StartSync()
+
 	s := enn.NewServer(db)
 	s.ThrotCmdWindow = time.Second * time.Duration(db.Config.ThrotCmdWin)
+	s.MaxArticleSize = db.Config.MaxArticleSize
+	s.MaxConns = int(db.Config.MaxConns)
+	s.MaxConnsPerIP = int(*db.Config.MaxConnsPerIP)
+	s.MaxConnsPerUser = int(*db.Config.MaxConnsPerUser)
+	s.LimitExempt = db.LimitExempt
+	s.Hooks = MetricsHooks()
 
 	handle := func(l net.Listener) {
 		for {
 			c, err := l.Accept()
 			if err != nil {
-				common.E("handle: %v", err)
+				common.Log.Error("accept", "err", err)
 				continue
 			}
 
-			tcpaddr, ok := c.RemoteAddr().(*net.TCPAddr)
-			if !ok {
-				c.Close()
-				common.E("handle addr: %v", c.RemoteAddr())
-				continue
-			}
-			if db.IsBanned(tcpaddr.IP) {
-				c.Close()
-				common.E("handle banned IP: %v", tcpaddr)
-				continue
-			}
-
-			// Ensure only one TCP connection per IP
-			conn, ok := ipDedup.Load(tcpaddr.IP.String())
-			if ok {
-				common.L("handle multiple conns: %v, close old one", tcpaddr)
-				conn.(net.Conn).Close()
-			}
-			ipDedup.Store(tcpaddr.IP.String(), c)
-
+			// RemoteAddr may wait for the PROXY protocol header
 			go func() {
+				tcpaddr, ok := c.RemoteAddr().(*net.TCPAddr)
+				if !ok {
+					c.Close()
+					common.Log.Error("accept: not a TCP address", "remote", c.RemoteAddr())
+					return
+				}
+				if db.IsBanned(tcpaddr.IP) {
+					common.Log.Info("accept: banned IP", "remote", tcpaddr)
+					c.SetDeadline(time.Now().Add(time.Second * 5))
+					c.Write([]byte("502 Access denied\r\n"))
+					c.Close()
+					return
+				}
 				s.Process(c)
-				ipDedup.Delete(tcpaddr.IP.String())
 			}()
 		}
 	}
 
 	fmt.Sscanf(*Listen, "%s %s %s", &plainBind, &tlsBind, &httpBind)
-	common.L("bind: plain=%q, tls=%q, http=%q", plainBind, tlsBind, httpBind)
+	common.Log.Info("bind", "plain", plainBind, "tls", tlsBind, "http", httpBind)
 
 	if plainBind != "" {
 		a, err := net.ResolveTCPAddr("tcp", plainBind)
@@ -97,17 +115,17 @@ func main() {
 		l, err := net.ListenTCP("tcp", a)
 		common.PanicIf(err, "error listening: %v", err)
 
-		go handle(l)
+		go handle(proxyListener(l))
 	}
 
 	if tlsBind != "" {
 		if ip := net.ParseIP(*ServerName); *ServerName == "" || *ServerName == "localhost" || len(ip) > 0 {
-			common.L("invalid server name, TLS disabled")
+			common.Log.Info("invalid server name, TLS disabled", "name", *ServerName)
 			goto SKIP_TLS
 		}
 
 		dir := filepath.Join(*Certbot, *ServerName)
-		common.L("load cert in %s", dir)
+		common.Log.Info("load cert", "dir", dir)
 
 		cert, err := tls.LoadX509KeyPair(dir+"/fullchain.pem", dir+"/privkey.pem")
 		common.PanicIf(err, "%%err")
@@ -116,18 +134,55 @@ func main() {
 		common.PanicIf(err, "%%err")
 		x509cert = *xc
 
-		l, err := tls.Listen("tcp", tlsBind, &tls.Config{Certificates: []tls.Certificate{cert}})
+		l, err := net.Listen("tcp", tlsBind)
 		common.PanicIf(err, "error setting up TLS listener: %v", err)
 
-		go handle(l)
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if db.Config.ClientCA != "" {
+			pem, err := ioutil.ReadFile(db.Config.ClientCA)
+			common.PanicIf(err, "read client CA: %%err")
+			config.ClientCAs = x509.NewCertPool()
+			common.PanicIf(!config.ClientCAs.AppendCertsFromPEM(pem), "no certificate in %v", db.Config.ClientCA)
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+			common.Log.Info("client certificates enabled", "ca", db.Config.ClientCA)
+		}
+
+		go handle(tls.NewListener(proxyListener(l), config))
 	}
 
 SKIP_TLS:
 	if httpBind != "" {
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(404) })
 		http.HandleFunc("/status.png", HandleGroups)
+		http.Handle("/metrics", adminOnly(http.HandlerFunc(HandleMetrics)))
+		http.Handle("/admin/", AdminHandler(s))
+		http.HandleFunc("/register", HandleRegister)
+		http.HandleFunc("/invite", HandleInvite)
 		go http.ListenAndServe(httpBind, nil)
 	}
 
 	select {}
 }
+
+// proxyListener expects the PROXY protocol from Config.ProxyHosts on l.
+func proxyListener(l net.Listener) net.Listener {
+	hosts := parseHosts(db.Config.ProxyHosts)
+	if len(hosts) == 0 {
+		return l
+	}
+	common.Log.Info("PROXY protocol enabled", "addr", l.Addr(), "hosts", db.Config.ProxyHosts)
+	return &enn.ProxyListener{
+		Listener: l,
+		Trusted:  func(ip net.IP) bool { return hostsContain(hosts, ip) },
+	}
+}
+
+func setupLog() {
+	var w io.Writer = os.Stdout
+	if *LogFile != "" {
+		f, err := common.OpenRotatingFile(*LogFile, *LogSize, *LogKeep)
+		common.PanicIf(err, "open log file: %%err")
+		w = f
+	}
+	common.Log.SetOutput(w, *LogFormat == "json", common.Level(*Verbosity))
+}
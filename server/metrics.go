@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/enn"
+)
+
+// Metrics are exported at /metrics in the Prometheus text format, behind the
+// same bearer token as the admin API.
+var metrics = struct {
+	sessions     int64
+	sessionTotal counterVec
+	commands     counterVec
+	latency      histogramVec
+	bytesIn      counterVec
+	bytesOut     counterVec
+	posts        counterVec
+	throtWaits   counterVec
+	throtSeconds counterVec
+}{
+	sessionTotal: counterVec{name: "enn_sessions_total", help: "NNTP sessions accepted."},
+	commands:     counterVec{name: "enn_commands_total", help: "NNTP commands by name and response code.", labels: []string{"command", "code"}},
+	latency: histogramVec{name: "enn_command_duration_seconds", help: "NNTP command latency.", labels: []string{"command"},
+		buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5}},
+	bytesIn:      counterVec{name: "enn_received_bytes_total", help: "Octets received from clients."},
+	bytesOut:     counterVec{name: "enn_sent_bytes_total", help: "Octets sent to clients."},
+	posts:        counterVec{name: "enn_posts_total", help: "Articles posted or transferred by result.", labels: []string{"result"}},
+	throtWaits:   counterVec{name: "enn_throttle_waits_total", help: "Commands delayed by the throttle."},
+	throtSeconds: counterVec{name: "enn_throttle_wait_seconds_total", help: "Time spent waiting for the throttle."},
+}
+
+// MetricsHooks returns the hooks feeding the metrics from an enn.Server.
+func MetricsHooks() enn.Hooks {
+	return enn.Hooks{
+		SessionStart: func(net.Addr) {
+			atomic.AddInt64(&metrics.sessions, 1)
+			metrics.sessionTotal.add(1)
+		},
+		SessionEnd: func(net.Addr) {
+			atomic.AddInt64(&metrics.sessions, -1)
+		},
+		Command: func(ev *enn.CommandEvent) {
+			metrics.commands.add(1, ev.Name, strconv.Itoa(ev.Code))
+			metrics.latency.observe(ev.Duration.Seconds(), ev.Name)
+			metrics.bytesIn.add(float64(ev.BytesIn))
+			metrics.bytesOut.add(float64(ev.BytesOut))
+		},
+		ThrotWait: func(wait time.Duration) {
+			metrics.throtWaits.add(1)
+			metrics.throtSeconds.add(wait.Seconds())
+		},
+	}
+}
+
+// postResult names the outcome of Post with a label of low cardinality.
+func postResult(err error) string {
+	e, ok := err.(*enn.NNTPError)
+	switch {
+	case err == nil:
+		return "accepted"
+	case !ok:
+		return "error"
+	case e == enn.ErrNotAuthenticated, e == enn.ErrNotMod:
+		return "not_authorized"
+	case e == enn.ErrPostingTooLarge, strings.HasPrefix(e.Msg, "Post too large"):
+		return "too_large"
+	case strings.HasPrefix(e.Msg, "Post cooldown"):
+		return "cooldown"
+	case strings.HasPrefix(e.Msg, "Path loop"):
+		return "loop"
+	case e == enn.ErrPostingFailed:
+		return "failed"
+	case e.Code == 441:
+		return "invalid"
+	}
+	return "other"
+}
+
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeGauge(w, "enn_sessions_active", "Open NNTP sessions.", float64(atomic.LoadInt64(&metrics.sessions)))
+	metrics.sessionTotal.write(w)
+	metrics.commands.write(w)
+	metrics.latency.write(w)
+	metrics.bytesIn.write(w)
+	metrics.bytesOut.write(w)
+	metrics.posts.write(w)
+	metrics.throtWaits.write(w)
+	metrics.throtSeconds.write(w)
+
+	if st, err := db.Index.Stat(); err == nil {
+		writeGauge(w, "enn_index_bytes", "Size of the index file.", float64(st.Size()))
+	}
+
+	db.muFile.Lock()
+	data := append([]*os.File{}, db.Data.Files...)
+	db.muFile.Unlock()
+	fmt.Fprintf(w, "# HELP enn_data_bytes Size of the data files.\n# TYPE enn_data_bytes gauge\n")
+	for _, f := range data {
+		if f == nil {
+			continue
+		}
+		if st, err := os.Stat(f.Name()); err == nil {
+			fmt.Fprintf(w, "enn_data_bytes{file=%q} %d\n", f.Name(), st.Size())
+		}
+	}
+
+	// Only the groups anyone may see, as listed to anonymous sessions
+	visible, _ := db.ListGroups(0)
+	groups := make([]enn.Group, 0, len(visible))
+	db.mu.RLock()
+	for _, g := range visible {
+		groups = append(groups, *g)
+	}
+	db.mu.RUnlock()
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	fmt.Fprintf(w, "# HELP enn_group_articles Articles in a group.\n# TYPE enn_group_articles gauge\n")
+	for _, g := range groups {
+		fmt.Fprintf(w, "enn_group_articles{group=%q} %d\n", g.Name, g.Count)
+	}
+	fmt.Fprintf(w, "# HELP enn_group_high Highest article number of a group.\n# TYPE enn_group_high gauge\n")
+	for _, g := range groups {
+		fmt.Fprintf(w, "enn_group_high{group=%q} %d\n", g.Name, g.High)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, v)
+}
+
+// labelPairs formats label names and values as {a="x",b="y"}.
+func labelPairs(names, values []string, extra ...string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", n, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *counterVec) add(v float64, lv ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = map[string]float64{}
+	}
+	c.values[strings.Join(lv, "\xff")] += v
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %v\n", c.name, c.values[""])
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, labelPairs(c.labels, strings.Split(k, "\xff")), c.values[k])
+	}
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogramVec) observe(v float64, lv ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.series == nil {
+		h.series = map[string]*histogram{}
+	}
+	k := strings.Join(lv, "\xff")
+	s := h.series[k]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s, lv := h.series[k], strings.Split(k, "\xff")
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, lv, "le", strconv.FormatFloat(b, 'g', -1, 64)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, lv, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, labelPairs(h.labels, lv), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, lv), s.count)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHidePrivateGroups(t *testing.T) {
+	old := db
+	defer func() { db = old }()
+	db = openTestDB(t, filepath.Join(t.TempDir(), "idx"), "a.example",
+		`G{"Name":"test.public","MaxLives":100}`,
+		`G{"Name":"test.private","MaxLives":100,"Read":"@mod"}`)
+
+	w := httptest.NewRecorder()
+	HandleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	if !strings.Contains(out, `enn_group_articles{group="test.public"}`) {
+		t.Fatalf("public group missing:\n%s", out)
+	}
+	if strings.Contains(out, "test.private") {
+		t.Fatalf("private group listed:\n%s", out)
+	}
+}
+
+func TestMetricsNeedToken(t *testing.T) {
+	old := db
+	defer func() { db = old }()
+	db = openTestDB(t, filepath.Join(t.TempDir(), "idx"), "a.example")
+	db.Config.AdminToken = "secret"
+	h := adminOnly(http.HandlerFunc(HandleMetrics))
+
+	for token, code := range map[string]int{"": 401, "wrong": 401, "secret": 200} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Fatalf("token %q: %d", token, w.Code)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coyove/enn"
+	"github.com/coyove/enn/server/common"
+)
+
+// PendingGroup is the pseudo group where mods find articles awaiting moderation.
+// Posting "approve [<msgid>]" or "reject [<msgid>] [reason]" as the Subject to
+// this group decides on the referred article.
+const PendingGroup = "enn.pending"
+
+type pendingArticle struct {
+	Ref    *common.ArticleRef
+	Groups []string
+	Num    int
+}
+
+func newPendingGroup() *Group {
+	return &Group{
+		Group: &enn.Group{
+			Name:        PendingGroup,
+			Description: "Articles awaiting moderation",
+			Posting:     enn.PostingModerated,
+		},
+		Articles: &common.HighLowSlice{},
+		BaseInfo: &common.BaseGroupInfo{Name: PendingGroup},
+	}
+}
+
+// queuePending writes an article for moderated groups to disk without
+// appending it anywhere, it shows up in PendingGroup until a mod decides.
+func (db *Backend) queuePending(a *common.Article, msgID string) error {
+	raw := common.MsgIDToRawMsgID(msgID, nil)
+	db.mu.RLock()
+	_, dup := db.PendingArticles[raw]
+	db.mu.RUnlock()
+	if dup {
+		return enn.ErrPostingFailed
+	}
+
+	ar, err := db.writeData(a.Marshal())
+	if err != nil {
+		return err
+	}
+	ar.SetMsgID(msgID)
+
+	if err := db.writeIndex([]byte(fmt.Sprintf("\nP%s %d %s %s %s",
+		msgID,
+		ar.Index,
+		strconv.FormatInt(ar.Offset, 36),
+		strconv.FormatInt(ar.Length, 36),
+		strings.Join(a.Refer, ",")))); err != nil {
+		return err
+	}
+
+	db.addPending(ar, a.Refer)
+	db.log.Info("queued for moderation", "msgid", msgID, "groups", strings.Join(a.Refer, ","))
+	return nil
+}
+
+func (db *Backend) addPending(ar *common.ArticleRef, groups []string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, high := db.Pending.Articles.Append(ar)
+	db.PendingArticles[ar.RawMsgID] = &pendingArticle{Ref: ar, Groups: groups, Num: high - 1}
+	db.updatePendingGroup()
+}
+
+func (db *Backend) removePending(raw [16]byte) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	p := db.PendingArticles[raw]
+	if p == nil {
+		return
+	}
+	delete(db.PendingArticles, raw)
+	db.Pending.Articles.Set(p.Num, nil)
+	db.updatePendingGroup()
+}
+
+func (db *Backend) updatePendingGroup() {
+	g := db.Pending
+	g.Group.Count = int64(len(db.PendingArticles))
+	g.Group.High = int64(g.Articles.High())
+	g.Group.Low = int64(g.Articles.Low() + 1)
+}
+
+// PendingList returns the pending articles in the order they were queued.
+func (db *Backend) PendingList() []*pendingArticle {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	refs, _, _ := db.Pending.Articles.Slice(0, db.Pending.Articles.High(), true)
+	var rv []*pendingArticle
+	for _, ar := range refs {
+		if ar == nil {
+			continue
+		}
+		if p := db.PendingArticles[ar.RawMsgID]; p != nil {
+			rv = append(rv, p)
+		}
+	}
+	return rv
+}
+
+// Moderate approves or rejects a pending article. Approved articles get an
+// Approved header naming the mod and are stored into their groups, the
+// decision is recorded in the index either way.
+func (db *Backend) Moderate(msgID string, approve bool, by, reason string) error {
+	// Whoever comes second finds the article gone from the queue
+	db.muModerate.Lock()
+	defer db.muModerate.Unlock()
+
+	raw := common.MsgIDToRawMsgID(msgID, nil)
+	db.mu.RLock()
+	p := db.PendingArticles[raw]
+	db.mu.RUnlock()
+	if p == nil {
+		return &enn.NNTPError{Code: 441, Msg: "No such pending article"}
+	}
+
+	act := &common.ModAction{
+		Action: "reject",
+		MsgID:  msgID,
+		By:     by,
+		Reason: reason,
+		Time:   time.Now().Unix(),
+	}
+
+	if approve {
+		act.Action = "approve"
+		a, err := db.loadArticle(p.Ref, false)
+		if err != nil {
+			return err
+		}
+		if a.Headers.Get("Approved") == "" {
+			a.Headers.Set("Approved", by)
+		}
+
+		var targets []*Group
+		db.mu.RLock()
+		for _, name := range p.Groups {
+			if g, ok := db.Groups[name]; ok {
+				targets = append(targets, g)
+			}
+		}
+		db.mu.RUnlock()
+		if len(targets) == 0 {
+			return &enn.NNTPError{Code: 441, Msg: "Groups of the article no longer exist"}
+		}
+		if err := db.store(a, msgID, targets); err != nil {
+			return err
+		}
+
+		var olds []string
+		for _, id := range strings.Fields(a.Headers.Get("Supersedes")) {
+			olds = append(olds, common.ExtractMsgID(id))
+		}
+		if err := db.supersede(olds, msgID, by); err != nil {
+			return err
+		}
+	}
+
+	if err := db.writeModAction(act); err != nil {
+		return err
+	}
+
+	db.removePending(raw)
+	db.log.Info("moderate", "action", act)
+	return nil
+}
+
+// moderateByPost handles a mod's post to PendingGroup. The command is taken
+// from the Subject, the target is either given there or is the last
+// article in References, so replying to a pending article just works.
+func (db *Backend) moderateByPost(article *enn.Article) error {
+	if db.AuthObject == nil {
+		return enn.ErrNotAuthenticated
+	}
+	if !db.IsMod() {
+		return enn.ErrNotMod
+	}
+
+	fields := strings.Fields(article.Header.Get("Subject"))
+	if len(fields) == 0 {
+		return enn.ErrSyntax
+	}
+	cmd, rest := fields[0], fields[1:]
+
+	var target string
+	if len(rest) > 0 && strings.HasPrefix(rest[0], "<") {
+		target, rest = rest[0], rest[1:]
+	} else if refs := strings.Fields(article.Header.Get("References")); len(refs) > 0 {
+		target = refs[len(refs)-1]
+	}
+	if target == "" {
+		return &enn.NNTPError{Code: 441, Msg: "Please refer an article"}
+	}
+	reason := strings.Join(rest, " ")
+
+	switch strings.ToLower(cmd) {
+	case "approve":
+		return db.Moderate(common.ExtractMsgID(target), true, db.AuthObject.User, reason)
+	case "reject":
+		return db.Moderate(common.ExtractMsgID(target), false, db.AuthObject.User, reason)
+	}
+	return &enn.NNTPError{Code: 441, Msg: "Unknown moderation command, use approve or reject"}
+}
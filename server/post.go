@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"strconv"
 	"strings"
@@ -15,13 +14,21 @@ import (
 	"github.com/coyove/enn/server/common"
 )
 
-func (db *Backend) Post(article *enn.Article) error {
-	// log.Printf("post: %#v", article.Header)
+// headerRoom is allowed for headers above the body size limit when the
+// article size limit is unset.
+const headerRoom = 64 << 10
 
-	// Check special subject 'd' issued by mods, which can delete the refered article
+func (db *Backend) Post(article *enn.Article) (err error) {
+	defer func() { metrics.posts.add(1, postResult(err)) }()
+
+	// Legacy form of cancel: special subject 'd' issued by mods, which can delete the refered article.
+	// Transferred articles are never commands.
 	subject := article.Header.Get("Subject")
 	switch strings.TrimSpace(subject) {
 	case "d":
+		if article.Transfer || db.Config.LegacyDelete != nil && !*db.Config.LegacyDelete {
+			break
+		}
 		if db.AuthObject == nil {
 			return enn.ErrNotAuthenticated
 		}
@@ -32,10 +39,38 @@ func (db *Backend) Post(article *enn.Article) error {
 		if refer == "" {
 			return &enn.NNTPError{Code: 441, Msg: "Please refer an article"}
 		}
-		common.D("delete article %q, auth: %#v", refer, db.AuthObject)
+		db.log.Debug("legacy delete", "msgid", refer, "user", db.AuthObject.User)
 		return db.DeleteArticle(common.ExtractMsgID(refer))
 	}
 
+	// Transfers skip injection, only peers may send them
+	if article.Transfer {
+		if tcpaddr, ok := article.RemoteAddr.(*net.TCPAddr); !ok || !db.trustedPeer(article, tcpaddr.IP) {
+			return enn.ErrTransferRejected
+		}
+	}
+
+	// Validate the article and add injection headers, articles from peers are already injected
+	if article.Transfer {
+		if err := db.Injector.Relay(article); err != nil {
+			db.log.Debug("transfer rejected", "err", err)
+			return err
+		}
+	} else if err := db.Injector.Inject(article); err != nil {
+		db.log.Debug("post rejected", "err", err)
+		return err
+	}
+
+	// Control messages are applied, not stored nor fed to peers
+	if article.Header.Get("Control") != "" {
+		return db.control(article)
+	}
+
+	// Mods decide on pending articles by posting to the pending group
+	if article.Header.Get("Newsgroups") == PendingGroup {
+		return db.moderateByPost(article)
+	}
+
 	// Check subject length
 	if utf8.RuneCountInString(subject) > 128 {
 		idx := strings.Index(subject, "=?")
@@ -48,29 +83,34 @@ func (db *Backend) Post(article *enn.Article) error {
 		}
 	}
 
-	// Check sender address, no mod spoof
-	email := common.ExtractEmail(article.Header.Get("From"))
-	isMod := false
-	if db.Mods[email] != nil {
-		if db.AuthObject == nil {
-			return enn.ErrNotAuthenticated
-		}
-		if !db.IsMod() {
-			return enn.ErrNotMod
-		}
-		isMod = true
-	}
-
-	// Check IP throt
 	tcpaddr, ok := article.RemoteAddr.(*net.TCPAddr)
 	if !ok {
-		common.E("post: invalid remote IP: %v", article.RemoteAddr)
+		db.log.Error("post: invalid remote address", "addr", article.RemoteAddr)
 		return enn.ErrPostingFailed
 	}
 
-	if !isMod {
+	// Peers relay articles of others, the checks below are for posting clients
+	trusted := db.trustedPeer(article, tcpaddr.IP)
+
+	// Check sender address, no spoofing of accounts
+	if !trusted {
+		if err := db.checkFrom(article); err != nil {
+			return err
+		}
+	}
+
+	// Supersedes must be checked before Newsgroups is used
+	olds, err := db.checkSupersedes(article, trusted)
+	if err != nil {
+		return err
+	}
+	email := common.ExtractEmail(article.Header.Get("From"))
+	isMod := db.IsMod()
+
+	// Check IP throt
+	if !isMod && !trusted {
 		if db.IsBanned(tcpaddr.IP) {
-			common.E("post: banned remote IP: %v", article.RemoteAddr)
+			db.log.Error("post: banned remote IP", "addr", article.RemoteAddr)
 			return enn.ErrPostingFailed
 		}
 
@@ -79,7 +119,12 @@ func (db *Backend) Post(article *enn.Article) error {
 		if ok {
 			cd := time.Duration(db.Config.PostIntervalSec) * time.Second
 			if diff := time.Since(v.(time.Time)); diff < cd {
-				return &enn.NNTPError{Code: 441, Msg: fmt.Sprintf("Post cooldown (wait %v)", cd-diff)}
+				// Peers offer the article again later
+				code := 441
+				if article.Transfer {
+					code = enn.ErrTransferFailed.Code
+				}
+				return &enn.NNTPError{Code: code, Msg: fmt.Sprintf("Post cooldown (wait %v)", cd-diff)}
 			}
 		}
 		db.ipCache.Add(ip, time.Now())
@@ -96,98 +141,146 @@ func (db *Backend) Post(article *enn.Article) error {
 		return &enn.NNTPError{Code: 441, Msg: fmt.Sprintf("Post too large (max %s)", common.FormatSize(db.Config.MaxPostSize))}
 	}
 
-	// If client sent a custom Message-Id, we will try to use it
-	var msgID string
-	if msgid := article.Header["Message-Id"]; len(msgid) > 0 {
-		msgID = common.ExtractMsgID(msgid[0])
-		common.D("post: predefined msgid %s", msgID)
-		delete(article.Header, "Message-Id")
-	} else {
-		msgID = strconv.FormatInt(time.Now().Unix(), 36) + strconv.FormatUint(uint64(rand.Uint32()), 36)
+	// Message-Id is always there after injection, ours are stored by their local part
+	msgID := common.ExtractMsgID(article.Header.Get("Message-Id"))
+	delete(article.Header, "Message-Id")
+
+	// Add our own lock next to the client's, so the poster can cancel without a Cancel-Key
+	if id := db.lockUser(); id != "" && !article.Transfer {
+		lock := enn.MakeCancelLock([]byte(db.Config.CancelSecret), msgID, id)
+		article.Header.Set("Cancel-Lock", strings.TrimSpace(article.Header.Get("Cancel-Lock")+" "+lock))
 	}
 
-	// Fill in custom headers
+	// Fill in internal headers, they are stripped before serving the article
 	article.Header["X-Message-Id"] = []string{msgID}
-	article.Header["X-Remote-Ip"] = []string{tcpaddr.IP.String()}
 	article.Header["X-Lines"] = []string{fmt.Sprint(bytes.Count(buf.Bytes(), []byte("\n")))}
 	article.Header["X-Length"] = []string{fmt.Sprint(buf.Len())}
+	if article.RawHeader != nil {
+		// Only what it adds to the parsed header is kept
+		packed := enn.PackRawHeader(db.servedHeader(article.Header), article.RawHeader)
+		article.Header["X-Raw-Header"] = []string{string(packed)}
+	}
 
+	// Newsgroups has been normalized to "A,B,..." by the injector
 	a := common.Article{
 		Headers: article.Header,
 		Body:    buf.Bytes(),
-		Refer:   article.Header["Newsgroups"],
-	}
-
-	// Fill in article referers, note two forms:
-	//   1. []string{"A", "B", ...}
-	//   2. []string{"A,B,..."}
-	for i := len(a.Refer) - 1; i >= 0; i-- {
-		ar := a.Refer[i]
-		groups := strings.Split(ar, ",")
-		if len(groups) > 1 {
-			for i := range groups {
-				groups[i] = strings.TrimSpace(groups[i])
-			}
-			a.Refer = append(a.Refer[:i], append(groups, a.Refer[i+1:]...)...)
-		}
+		Refer:   strings.Split(article.Header.Get("Newsgroups"), ","),
 	}
 
-	// If Message-Id has been used, then return error
-	if _, ok := db.Articles[common.MsgIDToRawMsgID(msgID, nil)]; ok {
+	// If Message-Id has been used, then return error, store checks again
+	if _, ok := db.internalGetArticle(msgID); ok {
 		return enn.ErrPostingFailed
 	}
 
-	// Write header+body to disk
-	ar, err := db.writeData(a.Marshal())
-	if err != nil {
-		return err
-	}
-	ar.RawMsgID = common.MsgIDToRawMsgID(msgID, nil)
-
-	// Write index to disk and then append it to each newsgroup
-	var postSuccess int
-	var lastError = enn.ErrPostingFailed
+	// Pick the groups this article will appear in
+	var targets []*Group
+	denied := false
 	for _, g := range a.Refer {
 		g, ok := db.Groups[g]
 		if !ok {
 			continue
 		}
 
+		if !trusted && !g.acl.post.allows(db) {
+			denied = true
+			continue
+		}
+
 		if g.Group.Posting == enn.PostingNotPermitted {
-			if !db.IsMod() {
+			if !db.IsMod() && !trusted {
 				continue
 			}
 		}
 
 		if limit := g.BaseInfo.MaxPostSize * 4 / 3; g.BaseInfo.MaxPostSize != 0 && n > limit {
-			common.D("post: %q large article %v (%d <-> %d)", g.Group.Name, msgID, n, limit)
+			db.log.Debug("post: article too large for group", "group", g.Group.Name, "msgid", msgID, "size", n, "limit", limit)
 			continue
 		}
 
+		targets = append(targets, g)
+	}
+	if len(targets) == 0 {
+		if denied {
+			return enn.ErrPostingNotPermitted
+		}
+		return enn.ErrPostingFailed
+	}
+
+	// Moderated groups only take approved articles, others wait in the pending queue
+	approved := (db.IsMod() || trusted) && article.Header.Get("Approved") != ""
+	for _, g := range targets {
+		if g.Group.Posting == enn.PostingModerated && !approved {
+			return db.queuePending(&a, msgID)
+		}
+	}
+
+	if err := db.store(&a, msgID, targets); err != nil {
+		return err
+	}
+	return db.supersede(olds, msgID, email)
+}
+
+// store writes an article to disk and appends it to each target group.
+func (db *Backend) store(a *common.Article, msgID string, targets []*Group) error {
+	// Article numbers are predicted for Xref, so stores are serialized from here
+	db.muPost.Lock()
+	defer db.muPost.Unlock()
+
+	// Another transfer of the same article may have got here first
+	if _, ok := db.internalGetArticle(msgID); ok {
+		return enn.ErrPostingFailed
+	}
+
+	xref := []string{db.ServerName}
+	for _, g := range targets {
+		xref = append(xref, g.Group.Name+":"+strconv.Itoa(g.Articles.High()+1))
+	}
+	a.Headers.Set("Xref", strings.Join(xref, " "))
+
+	// Listings take the size on the wire from here instead of rebuilding the header
+	hdr := db.servedHeader(a.Headers)
+	a.Headers["X-Header-Size"] = []string{strconv.Itoa(enn.HeaderSize(hdr, rawHeader(a.Headers, hdr)))}
+
+	// Write header+body to disk
+	ar, err := db.writeData(a.Marshal())
+	if err != nil {
+		return err
+	}
+	ar.SetMsgID(msgID)
+
+	// Write index to disk and then append it to each newsgroup
+	var postSuccess int
+	var lastError = enn.ErrPostingFailed
+	for _, g := range targets {
 		if err := db.writeIndex([]byte(fmt.Sprintf("\nA%s %s %d %s %s",
 			g.Group.Name,
 			msgID,
 			ar.Index,
 			strconv.FormatInt(ar.Offset, 36),
 			strconv.FormatInt(ar.Length, 36)))); err != nil {
-			common.D("post: %q write index %err", g.Group.Name, err)
+			db.log.Error("post: write index", "group", g.Group.Name, "err", err)
 			continue
 		}
 
 		g.Append(db, ar)
+		db.mu.Lock()
 		g.Group.Low = int64(g.Articles.Low() + 1)
 		g.Group.High = int64(g.Articles.High()+1) - 1
 		g.Group.Count = int64(g.Articles.Len())
+		db.mu.Unlock()
 
-		common.D("post: %q new article %v", g.Group.Name, msgID)
+		db.log.Debug("new article", "group", g.Group.Name, "msgid", msgID)
 		postSuccess++
 	}
 
-	if postSuccess > 0 {
-		db.Articles[common.MsgIDToRawMsgID(msgID, nil)] = ar
-	} else {
+	if postSuccess == 0 {
 		return lastError
 	}
+	db.mu.Lock()
+	db.Articles[common.MsgIDToRawMsgID(msgID, nil)] = ar
+	db.mu.Unlock()
+	db.enqueue(a, msgID, targets)
 	return nil
 }
 
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coyove/enn"
+)
+
+func TestDuplicatePost(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "idx"), "a.example", fillGroups[0])
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h := textproto.MIMEHeader{}
+			h.Set("From", "poster <poster@example.com>")
+			h.Set("Newsgroups", "test.a")
+			h.Set("Subject", "twice")
+			h.Set("Message-Id", "<dup@post.test>")
+			errs <- db.Post(&enn.Article{
+				Header:     h,
+				Body:       strings.NewReader("body\r\n"),
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 2, byte(i))},
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	stored := 0
+	for err := range errs {
+		if err == nil {
+			stored++
+		}
+	}
+	if g := db.Groups["test.a"].Group; stored != 1 || g.Count != 1 {
+		t.Fatalf("stored %d times, %d in the group", stored, g.Count)
+	}
+}
+
+func TestLegacyDeleteSkipsTransfers(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "idx"), "a.example", fillGroups[0])
+	postTestArticle(t, db, "test.a", "<a0@post.test>", 0)
+
+	peer := *db
+	peer.trusted = true
+	h := textproto.MIMEHeader{}
+	h.Set("From", "poster <poster@example.com>")
+	h.Set("Newsgroups", "test.a")
+	h.Set("Subject", "d")
+	h.Set("References", "<a0@post.test>")
+	h.Set("Message-Id", "<d@peer.example>")
+	h.Set("Date", "Mon, 02 Jan 2006 15:04:05 -0700")
+	h.Set("Path", "peer.example!not-for-mail")
+	err := peer.Post(&enn.Article{
+		Header:     h,
+		Body:       strings.NewReader("body\r\n"),
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 2, 1)},
+		Transfer:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"<a0@post.test>", "<d@peer.example>"} {
+		if _, ok := db.internalGetArticle(id); !ok {
+			t.Fatalf("%s missing", id)
+		}
+	}
+}
+
+func TestNewgroupUnmoderates(t *testing.T) {
+	hash, _ := hashPassword("password")
+	db := openTestDB(t, filepath.Join(t.TempDir(), "idx"), "a.example", append(fillGroups,
+		`U{"Name":"mod@example.com","Password":"`+hash+`","Role":"mod"}`)...)
+	sess, err := db.Authenticate("mod@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []struct {
+		control string
+		posting enn.PostingStatus
+	}{
+		{"newgroup test.m", enn.PostingPermitted},
+		{"newgroup test.m moderated", enn.PostingModerated},
+	} {
+		postTestBody(t, sess.(*Backend), "test.m", fmt.Sprintf("<c%d@post.test>", i), "", i,
+			textproto.MIMEHeader{"Control": {c.control}})
+		if g, _ := db.internalGetGroup("test.m"); g.Group.Posting != c.posting {
+			t.Fatalf("%s: posting %v", c.control, g.Group.Posting)
+		}
+	}
+}
+
+func TestServerCancelLock(t *testing.T) {
+	hash, _ := hashPassword("password")
+	db := openTestDB(t, filepath.Join(t.TempDir(), "idx"), "a.example", fillGroups[0],
+		`U{"Name":"user@example.com","Password":"`+hash+`","Role":"user"}`)
+	sess, err := db.Authenticate("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Anonymous posters behind one address are not told apart
+	postTestArticle(t, db, "test.a", "<anon@post.test>", 0)
+	postTestArticle(t, sess.(*Backend), "test.a", "<user@post.test>", 1)
+	for id, locked := range map[string]bool{"<anon@post.test>": false, "<user@post.test>": true} {
+		a, err := db.GetArticle(nil, id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Header.Get("Cancel-Lock") != ""; got != locked {
+			t.Fatalf("%s: Cancel-Lock %q", id, a.Header.Get("Cancel-Lock"))
+		}
+	}
+}
+
+func TestCancelSecretRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idx")
+	db := openTestDB(t, path, "a.example", `C{"MaxPostSize":1000}`)
+	secret := db.Config.CancelSecret
+	closeTestDB(db)
+
+	// Only the secret is added to the recorded config, not the defaults
+	buf, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(buf), "DataFileSize") || !strings.Contains(string(buf), `{"MaxPostSize":1000,`) {
+		t.Fatalf("config not kept as recorded:\n%s", buf)
+	}
+	db = openTestDB(t, path, "a.example")
+	if db.Config.CancelSecret != secret || db.Config.MaxPostSize != 1000 || db.Config.DataFileSize != 1e9 {
+		t.Fatalf("config %+v", db.Config)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/enn/server/common"
+)
+
+const (
+	inviteTTL      = 7 * 24 * time.Hour
+	minPasswordLen = 8
+)
+
+var muRegister sync.Mutex
+
+// rateLimiter allows n hits per window and key.
+type rateLimiter struct {
+	mu     sync.Mutex
+	n      int
+	window time.Duration
+	hits   map[string][]time.Time
+}
+
+func newRateLimiter(n int, window time.Duration) *rateLimiter {
+	return &rateLimiter{n: n, window: window, hits: map[string][]time.Time{}}
+}
+
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	hits := l.hits[key][:0]
+	for _, t := range l.hits[key] {
+		if now.Sub(t) < l.window {
+			hits = append(hits, t)
+		}
+	}
+	if len(hits) >= l.n {
+		l.hits[key] = hits
+		return false
+	}
+	l.hits[key] = append(hits, now)
+	return true
+}
+
+var (
+	inviteLimit   = newRateLimiter(20, time.Hour)
+	registerLimit = newRateLimiter(5, time.Hour)
+)
+
+// setInvite adds or updates an invite code, replaying I records.
+func (db *Backend) setInvite(inv *common.InviteInfo) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.Invites[inv.Code] = inv
+}
+
+func (db *Backend) writeInvite(inv *common.InviteInfo) error {
+	buf := bytes.NewBufferString("\nI")
+	json.NewEncoder(buf).Encode(inv)
+	return db.writeIndex(buf.Bytes())
+}
+
+// NewInvite issues a single use invite code on behalf of by.
+func (db *Backend) NewInvite(by string) (*common.InviteInfo, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	inv := &common.InviteInfo{
+		Code:    base32.StdEncoding.EncodeToString(buf),
+		By:      by,
+		Created: now.Unix(),
+		Expires: now.Add(inviteTTL).Unix(),
+	}
+	if err := db.writeInvite(inv); err != nil {
+		return nil, err
+	}
+	db.setInvite(inv)
+	db.log.Info("invite issued", "by", by)
+	return inv, nil
+}
+
+// Register redeems an invite code for a new account. Names of accounts
+// having an @ are email addresses they own, so those are not self-chosen.
+func (db *Backend) Register(code, name, pass string) error {
+	switch {
+	case name == "" || len(name) > 64 || strings.ContainsAny(name, " \t\r\n:,<>\"@"):
+		return fmt.Errorf("invalid user name")
+	case len(pass) < minPasswordLen:
+		return fmt.Errorf("password must have at least %d characters", minPasswordLen)
+	}
+
+	muRegister.Lock()
+	defer muRegister.Unlock()
+
+	db.mu.RLock()
+	inv := db.Invites[strings.ToUpper(strings.TrimSpace(code))]
+	db.mu.RUnlock()
+	if inv == nil || inv.UsedBy != "" || time.Now().Unix() > inv.Expires {
+		return fmt.Errorf("invalid invite code")
+	}
+	if db.getUser(name) != nil || db.accountOf(name) != nil {
+		return fmt.Errorf("user name taken")
+	}
+
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+	u := &common.UserInfo{Name: name, Password: hash, Role: common.RoleUser}
+	used := *inv
+	used.UsedBy, used.Used = name, time.Now().Unix()
+
+	// The account first, a crash in between leaves the invite usable
+	if err := db.writeUser(u); err != nil {
+		return err
+	}
+	db.setUser(u)
+	if err := db.writeInvite(&used); err != nil {
+		return err
+	}
+	db.setInvite(&used)
+	db.log.Info("user registered", "user", name, "invited_by", inv.By)
+	return nil
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// HandleInvite issues an invite code to a mod authenticated by HTTP basic auth.
+func HandleInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if !inviteLimit.allow(remoteIP(r)) {
+		http.Error(w, "too many requests", 429)
+		return
+	}
+	user, pass, _ := r.BasicAuth()
+	id, err := db.Auth.Authenticate(user, pass)
+	if err != nil || (id.Role != common.RoleMod && id.Role != common.RoleAdmin) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="enn"`)
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	inv, err := db.NewInvite(id.User)
+	if err != nil {
+		db.log.Error("issue invite", "err", err)
+		http.Error(w, "internal error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+const registerForm = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Register</title></head><body>
+<p>%s</p>
+<form method="post">
+<p>Invite code <input name="code" required></p>
+<p>User name <input name="user" required></p>
+<p>Password <input name="password" type="password" minlength="%d" required></p>
+<p><input type="submit" value="Register"></p>
+</form></body></html>
+`
+
+// HandleRegister serves the registration form and redeems invite codes.
+func HandleRegister(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	msg := ""
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if !registerLimit.allow(remoteIP(r)) {
+			w.WriteHeader(429)
+			msg = "Too many attempts, try again later."
+			break
+		}
+		user := strings.TrimSpace(r.PostFormValue("user"))
+		if err := db.Register(r.PostFormValue("code"), user, r.PostFormValue("password")); err != nil {
+			w.WriteHeader(400)
+			msg = "Registration failed: " + err.Error()
+			break
+		}
+		fmt.Fprintf(w, "<!DOCTYPE html><p>Welcome %s, you can now log in with AUTHINFO.</p>\n", html.EscapeString(user))
+		return
+	default:
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	fmt.Fprintf(w, registerForm, html.EscapeString(msg), minPasswordLen)
+}
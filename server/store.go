@@ -2,13 +2,14 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/coyove/common/lru"
@@ -19,6 +20,7 @@ import (
 type Group struct {
 	Group         *enn.Group
 	BaseInfo      *common.BaseGroupInfo
+	acl           groupACL
 	Articles      *common.HighLowSlice
 	NoPurgeNotify bool
 }
@@ -32,7 +34,7 @@ func (g *Group) Append(b *Backend, ar *common.ArticleRef) {
 			for _, p := range purged {
 				tmp.WriteString(fmt.Sprintf("\nD%s", p.MsgID()))
 			}
-			common.D("purge in append: %v, len: %d", b.writeIndex(tmp.Bytes()), len(purged))
+			b.log.Debug("purge in append", "group", g.Group.Name, "purged", len(purged), "err", b.writeIndex(tmp.Bytes()))
 		}
 
 		b.mu.Lock()
@@ -44,74 +46,148 @@ func (g *Group) Append(b *Backend, ar *common.ArticleRef) {
 }
 
 type Backend struct {
-	Config     common.Config
+	Config common.Config
+	// rawConfig is Config as recorded, before the defaults, for rewriting it
+	rawConfig  common.Config
 	ServerName string
 
 	Groups    map[string]*Group
 	Articles  map[[16]byte]*common.ArticleRef
-	Mods      map[string]*common.ModInfo
+	Users     map[string]*common.UserInfo
+	Invites   map[string]*common.InviteInfo
 	Blacklist map[string]*net.IPNet
 
+	Pending         *Group
+	PendingArticles map[[16]byte]*pendingArticle
+	Superseded      map[[16]byte]*supersededArticle
+	Peers           map[string]*peer
+
 	Index *os.File
-	Data  []*os.File
+	Data  *DataFiles
+	// tails are torn writes left to trimTails, nil when there are none
+	tails *tornTails
 
 	AuthObject *common.AuthObject
+	Auth       enn.Authenticator
+	Injector   *enn.Injector
+	SuckMarks  map[string]int64
+
+	// trusted is set for sessions of peers, logged in or sucking
+	trusted bool
+
+	exemptHosts []*net.IPNet
+
+	// remoteIP is the client address of a session
+	remoteIP net.IP
 
 	ipCache *lru.Cache
+	log     *common.Logger
+	muPost  *sync.Mutex
 	muFile  *sync.Mutex
 	mu      *sync.RWMutex
+	// muModerate serializes decisions on pending articles
+	muModerate *sync.Mutex
+}
+
+// DataFiles are the data files, articles are written to the last one.
+// Rotation and GC change them under muFile, sessions share them.
+type DataFiles struct {
+	Files []*os.File
+	// dirty is set by writes not yet fsynced in batch durability mode
+	dirty bool
 }
 
 func (db *Backend) IsMod() bool {
+	r, _ := db.role()
+	return r == common.RoleMod || r == common.RoleAdmin
+}
+
+// role returns the current role of the session and false if it is not
+// logged in, or its account has been deleted or disabled since.
+func (db *Backend) role() (string, bool) {
 	if db.AuthObject == nil {
-		return false
+		return "", false
 	}
-	mi := db.Mods[db.AuthObject.User]
-	if mi == nil {
-		return false
+	if !db.AuthObject.Account {
+		return db.AuthObject.Role, true
 	}
-	return mi.Password == db.AuthObject.Pass
+	u := db.getUser(db.AuthObject.User)
+	if u == nil || u.Disabled {
+		return "", false
+	}
+	return u.Role, true
 }
 
 func (db *Backend) writeData(buf []byte) (*common.ArticleRef, error) {
-	const sep = "\x01\x23\x45\x67\x89\xab\xcd\xef"
+	hdr := dataHeader(buf)
 
 	db.muFile.Lock()
 	defer db.muFile.Unlock()
+	if db.tails != nil {
+		return nil, errTornTails
+	}
 
-	f := db.Data[len(db.Data)-1]
+	f := db.Data.Files[len(db.Data.Files)-1]
 
-	if _, err := f.Seek(0, 2); err != nil {
+	end, err := f.Seek(0, 2)
+	if err != nil {
 		return nil, err
 	}
-
-	if _, err := f.WriteString(sep); err != nil {
-		return nil, err
+	if end > 0 && end+int64(len(hdr)+len(buf)) > db.Config.DataFileSize {
+		if f, err = db.rotateData(); err != nil {
+			return nil, err
+		}
+		end = 0
 	}
 
-	if err := binary.Write(f, binary.BigEndian, int64(len(buf))); err != nil {
-		return nil, err
+	offset := end + int64(len(hdr))
+	n, err := f.Write(append(hdr, buf...))
+	if err == nil && n != len(hdr)+len(buf) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		err = db.synced(f)
 	}
-
-	offset, err := f.Seek(0, 1)
 	if err != nil {
+		// Do not leave a partial record for the next one to follow
+		f.Truncate(end)
 		return nil, err
 	}
 
-	n, err := f.Write(buf)
+	return &common.ArticleRef{
+		Index:  len(db.Data.Files) - 1,
+		Offset: offset,
+		Length: int64(len(buf)),
+	}, nil
+}
+
+// rotateData starts a new data file, muFile is held.
+func (db *Backend) rotateData() (*os.File, error) {
+	name := db.Index.Name() + ".data." + strconv.Itoa(len(db.Data.Files))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0777)
 	if err != nil {
 		return nil, err
 	}
-
-	if n != len(buf) {
-		return nil, io.ErrShortWrite
+	if db.Config.Durability != "none" {
+		// The batch sync only knows the last one
+		if err := db.Data.Files[len(db.Data.Files)-1].Sync(); err != nil {
+			f.Close()
+			return nil, err
+		}
 	}
+	db.log.Info("new data file", "file", name)
+	db.Data.Files = append(db.Data.Files, f)
+	return f, nil
+}
 
-	return &common.ArticleRef{
-		Index:  len(db.Data) - 1,
-		Offset: offset,
-		Length: int64(n),
-	}, nil
+// dataFile returns the data file i, nil when it does not exist (anymore).
+func (db *Backend) dataFile(i int) *os.File {
+	db.muFile.Lock()
+	defer db.muFile.Unlock()
+	if i < 0 || i >= len(db.Data.Files) {
+		return nil
+	}
+	return db.Data.Files[i]
 }
 
 func (db *Backend) WriteCommand(buf []byte) error {
@@ -121,103 +197,168 @@ func (db *Backend) WriteCommand(buf []byte) error {
 func (db *Backend) writeIndex(buf []byte) error {
 	db.muFile.Lock()
 	defer db.muFile.Unlock()
+	if db.tails != nil {
+		return errTornTails
+	}
 	f := db.Index
+	buf = sumLines(buf)
 
-	if _, err := f.Seek(0, 2); err != nil {
+	end, err := f.Seek(0, 2)
+	if err != nil {
 		return err
 	}
 	n, err := f.Write(buf)
-	if err != nil {
-		return err
+	if err == nil && n != len(buf) {
+		err = io.ErrShortWrite
 	}
-	if n != len(buf) {
-		return io.ErrShortWrite
+	if err == nil {
+		err = db.synced(f)
 	}
-	return nil
+	if err != nil {
+		f.Truncate(end)
+	}
+	return err
 }
 
 func (db *Backend) ListGroups(max int) ([]*enn.Group, error) {
+	// acls look the account up, so they are checked out of the lock
 	db.mu.RLock()
-	defer db.mu.RUnlock()
+	groups := make([]*Group, 0, len(db.Groups))
+	for _, g := range db.Groups {
+		groups = append(groups, g)
+	}
+	db.mu.RUnlock()
 
 	var rv []*enn.Group
-	for _, g := range db.Groups {
-		rv = append(rv, g.Group)
+	for _, g := range groups {
+		if g.acl.list.allows(db) {
+			rv = append(rv, g.Group)
+		}
+	}
+	if db.IsMod() {
+		rv = append(rv, db.Pending.Group)
 	}
 	return rv, nil
 }
 
 func (db *Backend) GetGroup(name string) (*enn.Group, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
-	group, ok := db.Groups[name]
-	if !ok {
+	group, ok := db.internalGetGroup(name)
+	if !ok || !group.acl.list.allows(db) {
 		return nil, enn.ErrNoSuchGroup
 	}
+	if !group.acl.read.allows(db) {
+		return nil, db.accessDenied()
+	}
 	return group.Group, nil
 }
 
-func (db *Backend) mkArticle(a *common.ArticleRef, headerOnly bool, errors *[]error) (A *enn.Article, E error) {
-	if a.Index >= len(db.Data) {
+// loadArticle reads the stored form of an article from the data files.
+func (db *Backend) loadArticle(a *common.ArticleRef, headerOnly bool) (*common.Article, error) {
+	df := db.dataFile(a.Index)
+	if df == nil {
 		return nil, enn.ErrInvalidArticleNumber
 	}
 
-	name := db.Data[a.Index].Name()
+	name := df.Name()
 	f, err := os.OpenFile(name, os.O_RDONLY, 0777)
 	if err != nil {
-		common.E("open %q: %v", name, err)
+		db.log.Error("open data file", "file", name, "err", err)
 		return nil, enn.ErrServerBad
 	}
+	defer f.Close()
+
+	// Early check
+	sum, hasSum, err := readDataHeader(f, a)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(a.Offset, 0); err != nil {
+		return nil, err
+	}
 
+	// Headers alone are read without verifying the whole record
+	rd := io.LimitReader(f, a.Length)
+	if hasSum && !headerOnly {
+		buf := make([]byte, a.Length)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		if checksum(buf) != sum {
+			return nil, fmt.Errorf("checksum mismatch")
+		}
+		rd = bytes.NewReader(buf)
+	}
+	as := &common.Article{}
+	if err := as.Unmarshal(rd, headerOnly); err != nil {
+		db.log.Error("corrupted article", "ref", a, "err", err)
+		return nil, err
+	}
+	return as, nil
+}
+
+func (db *Backend) mkArticle(a *common.ArticleRef, headerOnly bool, errors *[]error) (A *enn.Article, E error) {
 	defer func() {
-		f.Close()
-		if E != nil {
+		if E != nil && E != enn.ErrServerBad {
 			if errors != nil {
 				*errors = append(*errors, fmt.Errorf("load data %v: %v", a.MsgID(), E))
 			} else {
-				common.E("load data %v: %v", a, E)
+				db.log.Error("load article", "ref", a, "err", E)
 			}
 			E = enn.ErrInvalidArticleNumber
 		}
 	}()
 
-	// Early check
-	var matchLength int64
-	f.Seek(a.Offset-8, 0)
-	binary.Read(f, binary.BigEndian, &matchLength)
-	if matchLength != a.Length {
-		return nil, fmt.Errorf("invalid length marker %d, expect %d", matchLength, a.Length)
+	as, err := db.loadArticle(a, headerOnly)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := f.Seek(a.Offset, 0); err != nil {
-		return nil, err
+	hdr := db.servedHeader(as.Headers)
+	na := &enn.Article{
+		Header: hdr,
+		Body:   bytes.NewReader(as.Body),
+	}
+	na.RawHeader = rawHeader(as.Headers, hdr)
+	// X-Length is the body size in wire octets, Bytes covers the whole article
+	bodyBytes, _ := strconv.Atoi(as.Headers.Get("X-Length"))
+	headerBytes, err := strconv.Atoi(as.Headers.Get("X-Header-Size"))
+	if err != nil {
+		headerBytes = enn.HeaderSize(hdr, na.RawHeader)
 	}
+	na.Bytes = headerBytes + 2 + bodyBytes
+	na.Lines, _ = strconv.Atoi(as.Headers.Get("X-Lines"))
+	return na, nil
+}
 
-	rd := io.LimitReader(f, a.Length)
-	as := common.Article{}
-	if err := as.Unmarshal(rd, headerOnly); err != nil {
-		common.E("corrupted article ref %v", err)
-		return nil, err
+// rawHeader returns the raw header block of a stored article served with
+// hdr, nil when none was kept.
+func rawHeader(stored, hdr textproto.MIMEHeader) []byte {
+	if raw, ok := stored["X-Raw-Header"]; ok {
+		return enn.UnpackRawHeader(hdr, []byte(raw[0]))
 	}
+	return nil
+}
 
-	hdr := make(textproto.MIMEHeader, len(as.Headers))
-	for k, v := range as.Headers {
+// servedHeader returns the header of a stored article as served, without
+// the internal headers.
+func (db *Backend) servedHeader(stored textproto.MIMEHeader) textproto.MIMEHeader {
+	hdr := make(textproto.MIMEHeader, len(stored))
+	for k, v := range stored {
 		switch k {
 		case "X-Message-Id":
-			hdr["Message-Id"] = []string{"<" + v[0] + "@" + db.ServerName + ">", v[0]}
+			if strings.HasPrefix(v[0], "<") {
+				hdr["Message-Id"] = v
+			} else {
+				hdr["Message-Id"] = []string{"<" + v[0] + "@" + db.ServerName + ">"}
+			}
+		case "X-Lines", "X-Length", "X-Remote-Ip", "X-Raw-Header", "X-Header-Size":
+			// Internal headers, never served
 		default:
 			hdr[k] = v
 		}
 	}
-
-	na := &enn.Article{
-		Header: hdr,
-		Body:   bytes.NewReader(as.Body),
-	}
-	na.Bytes, _ = strconv.Atoi(hdr.Get("X-Length"))
-	na.Lines, _ = strconv.Atoi(hdr.Get("X-Lines"))
-	return na, nil
+	return hdr
 }
 
 func (db *Backend) DeleteArticle(msgID string) error {
@@ -231,6 +372,9 @@ func (db *Backend) DeleteArticle(msgID string) error {
 }
 
 func (db *Backend) internalGetGroup(name string) (*Group, bool) {
+	if name == PendingGroup && db.IsMod() {
+		return db.Pending, true
+	}
 	db.mu.RLock()
 	gs, ok := db.Groups[name]
 	db.mu.RUnlock()
@@ -244,28 +388,65 @@ func (db *Backend) internalGetArticle(msgID string) (*common.ArticleRef, bool) {
 	return gs, ok
 }
 
+// lookupArticle finds an article in the context of gs, which may be the
+// pending group whose articles are not in db.Articles.
+func (db *Backend) lookupArticle(gs *Group, msgID string) (*common.ArticleRef, bool) {
+	if gs != nil && gs == db.Pending {
+		db.mu.RLock()
+		p, ok := db.PendingArticles[common.MsgIDToRawMsgID(msgID, nil)]
+		db.mu.RUnlock()
+		if ok {
+			return p.Ref, true
+		}
+	}
+	if ar, ok := db.internalGetArticle(msgID); ok {
+		return ar, true
+	}
+	if db.IsMod() {
+		// Mods can still read earlier revisions of superseded articles
+		db.mu.RLock()
+		s, ok := db.Superseded[common.MsgIDToRawMsgID(msgID, nil)]
+		db.mu.RUnlock()
+		if ok {
+			return s.Ref, true
+		}
+	}
+	return nil, false
+}
+
 func (db *Backend) GetArticle(group *enn.Group, id string, ho bool) (*enn.Article, error) {
 	msgID := id
 
+	var groupStorage *Group
+	if group != nil {
+		groupStorage, _ = db.internalGetGroup(group.Name)
+	}
+
 	if intId, err := strconv.ParseInt(id, 10, 64); err == nil {
-		groupStorage, ok := db.internalGetGroup(group.Name)
-		if !ok {
+		if groupStorage == nil {
 			return nil, enn.ErrNoSuchGroup
 		}
+		if !groupStorage.acl.read.allows(db) {
+			return nil, db.accessDenied()
+		}
 
 		ar, _ := groupStorage.Articles.Get(int(intId - 1))
 		if ar == nil {
-			common.E("get article %q in %v not found ", id, group)
+			db.log.Error("article not found", "group", group.Name, "num", id)
 			return nil, enn.ErrInvalidArticleNumber
 		}
 		msgID = ar.MsgID()
 	}
 	msgID = common.ExtractMsgID(msgID)
-	a, _ := db.internalGetArticle(msgID)
+	a, _ := db.lookupArticle(groupStorage, msgID)
 	if a == nil {
 		return nil, enn.ErrInvalidMessageID
 	}
-	return db.mkArticle(a, ho, nil)
+	article, err := db.mkArticle(a, ho, nil)
+	if err == nil && groupStorage != db.Pending && !db.canReadArticle(article) {
+		return nil, enn.ErrInvalidMessageID
+	}
+	return article, err
 }
 
 func (db *Backend) GetArticles(group *enn.Group, from, to int64, ho bool) ([]enn.NumberedArticle, error) {
@@ -273,6 +454,9 @@ func (db *Backend) GetArticles(group *enn.Group, from, to int64, ho bool) ([]enn
 	if !ok {
 		return nil, enn.ErrNoSuchGroup
 	}
+	if !gs.acl.read.allows(db) {
+		return nil, db.accessDenied()
+	}
 
 	var rv []enn.NumberedArticle
 	var errors []error
@@ -281,7 +465,7 @@ func (db *Backend) GetArticles(group *enn.Group, from, to int64, ho bool) ([]enn
 		if v == nil {
 			continue
 		}
-		a, ok := db.internalGetArticle(v.MsgID())
+		a, ok := db.lookupArticle(gs, v.MsgID())
 		if !ok {
 			continue
 		}
@@ -299,7 +483,7 @@ func (db *Backend) GetArticles(group *enn.Group, from, to int64, ho bool) ([]enn
 		if len(errors) > 10 {
 			errors = append(errors[:5], errors[len(errors)-5:]...)
 		}
-		common.E("get articles, multiple errors: %v", errors)
+		db.log.Error("get articles", "group", group.Name, "errors", fmt.Sprint(errors))
 	}
 
 	return rv, nil
@@ -315,6 +499,52 @@ func (db *Backend) AllowPost() bool {
 
 func (db *Backend) Authenticate(user, pass string) (enn.Backend, error) {
 	tb2 := *db
-	tb2.AuthObject = &common.AuthObject{user, pass}
+	tb2.AuthObject = &common.AuthObject{User: user}
+	if tb2.trusted = db.peerLogin(user, pass); tb2.trusted {
+		return &tb2, nil
+	}
+	id, err := db.Auth.Authenticate(user, pass)
+	if err != nil {
+		if err != enn.ErrAuthRejected {
+			db.log.Error("authenticate", "user", user, "err", err)
+		}
+		db.log.Info("login rejected", "user", user)
+		return nil, enn.ErrAuthRejected
+	}
+	// Whichever authenticator accepted it, the name of an account is that account
+	tb2.AuthObject = &common.AuthObject{User: id.User, Role: id.Role, Account: db.getUser(id.User) != nil}
 	return &tb2, nil
 }
+
+// AuthenticateCert logs in the account named by the first email address
+// of a verified client certificate, or by its subject common name.
+func (db *Backend) AuthenticateCert(cert *x509.Certificate) (string, enn.Backend, error) {
+	name := cert.Subject.CommonName
+	if len(cert.EmailAddresses) > 0 {
+		name = cert.EmailAddresses[0]
+	}
+	id, err := db.loginCert(name)
+	if err != nil {
+		return "", nil, err
+	}
+	tb2 := *db
+	tb2.AuthObject = &common.AuthObject{User: id.User, Role: id.Role, Account: true}
+	return id.User, &tb2, nil
+}
+
+func (db *Backend) ForSession(remote net.Addr, l *common.Logger) enn.Backend {
+	tb2 := *db
+	tb2.log = l
+	if tcpaddr, ok := remote.(*net.TCPAddr); ok {
+		tb2.remoteIP = tcpaddr.IP
+	}
+	return &tb2
+}
+
+// accessDenied is the error for groups the session cannot read.
+func (db *Backend) accessDenied() error {
+	if db.AuthObject == nil {
+		return enn.ErrNotAuthenticated
+	}
+	return &enn.NNTPError{Code: 502, Msg: "Access denied"}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coyove/enn"
+	"github.com/coyove/enn/server/common"
+)
+
+// suckBatch is the number of articles asked for by one OVER.
+const suckBatch = 500
+
+// Suck imports new articles of the groups matching Config.SuckGroups from
+// the upstream server Config.SuckAddr. Articles are posted as transfers,
+// keeping their Message-ID, and the last article number seen in each
+// group is recorded in an S record so the next run carries on from there.
+func (db *Backend) Suck() error {
+	addr, wildmat := db.Config.SuckAddr, db.Config.SuckGroups
+	if addr == "" {
+		return fmt.Errorf("no upstream server, see -config")
+	}
+	if wildmat == "" {
+		wildmat = "*"
+	}
+
+	remote, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	c, err := enn.Dial(addr, feedTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Quit()
+	c.Cmd(20, "MODE READER")
+
+	active, err := c.List("ACTIVE")
+	if err != nil {
+		return err
+	}
+
+	sdb := *db
+	sdb.trusted = true
+
+	total := 0
+	for _, line := range active {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !enn.MatchWildmat(wildmat, fields[0]) {
+			continue
+		}
+		if _, ok := db.internalGetGroup(fields[0]); !ok {
+			db.log.Info("suck: no such group here, skipped", "group", fields[0])
+			continue
+		}
+		n, err := sdb.suckGroup(c, addr, fields[0], remote)
+		total += n
+		if err != nil {
+			return err
+		}
+	}
+	db.log.Info("suck done", "upstream", addr, "stored", total)
+	return nil
+}
+
+func (db *Backend) suckGroup(c *enn.Client, addr, group string, remote net.Addr) (stored int, err error) {
+	key := addr + " " + group
+	_, low, high, err := c.Group(group)
+	if err != nil {
+		return 0, err
+	}
+
+	mark := db.SuckMarks[key]
+	if mark < low-1 {
+		mark = low - 1
+	}
+	defer func() {
+		if mark <= db.SuckMarks[key] {
+			return
+		}
+		db.SuckMarks[key] = mark
+		if werr := db.writeIndex([]byte(fmt.Sprintf("\nS%s %d", key, mark))); werr != nil && err == nil {
+			err = werr
+		}
+		db.log.Info("suck group", "upstream", addr, "group", group, "stored", stored, "mark", mark)
+	}()
+
+	for from := mark + 1; from <= high; from += suckBatch {
+		to := from + suckBatch - 1
+		if to > high {
+			to = high
+		}
+		over, err := c.Over(from, to)
+		if err != nil {
+			return stored, err
+		}
+
+		for _, line := range over {
+			fields := strings.Split(line, "\t")
+			if len(fields) < 5 {
+				continue
+			}
+			num, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				continue
+			}
+			msgID := strings.TrimSpace(fields[4])
+
+			if _, ok := db.internalGetArticle(common.ExtractMsgID(msgID)); !ok {
+				a, err := c.Article(fields[0])
+				if _, ok := err.(*enn.NNTPError); err != nil && !ok {
+					return stored, err
+				}
+				if err == nil {
+					a.RemoteAddr = remote
+					a.Transfer = true
+					if err := db.Post(a); err != nil {
+						// The mark stays before articles worth trying again
+						if e, ok := err.(*enn.NNTPError); !ok || e.Code == enn.ErrTransferFailed.Code {
+							return stored, err
+						}
+						db.log.Debug("suck: not stored", "group", group, "msgid", msgID, "err", err)
+					} else {
+						stored++
+					}
+				} else {
+					db.log.Debug("suck: not fetched", "group", group, "num", num, "err", err)
+				}
+			}
+			mark = num
+		}
+		mark = to
+	}
+	return stored, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coyove/enn"
+	"github.com/coyove/enn/server/common"
+)
+
+type supersededArticle struct {
+	Ref   *common.ArticleRef
+	NewID string
+	Time  int64
+}
+
+// checkSupersedes resolves the articles named in the Supersedes header of
+// a new article. The poster must be a mod or a trusted peer, present a
+// Cancel-Key matching the Cancel-Lock of every one of them, or be logged in
+// as the account owning their From. Newsgroups is extended with the groups
+// of the replaced articles, so the new version appears wherever the old one
+// did.
+func (db *Backend) checkSupersedes(article *enn.Article, trusted bool) ([]string, error) {
+	ids := strings.Fields(article.Header.Get("Supersedes"))
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	groups := strings.Split(article.Header.Get("Newsgroups"), ",")
+
+	var olds []string
+	for _, id := range ids {
+		msgID := common.ExtractMsgID(id)
+		ar, ok := db.internalGetArticle(msgID)
+		if !ok {
+			return nil, &enn.NNTPError{Code: 441, Msg: "Superseded article not found: " + id}
+		}
+		old, err := db.loadArticle(ar, true)
+		if err != nil {
+			return nil, err
+		}
+		if !trusted && !db.IsMod() && !db.canCancel(old, msgID, article) &&
+			!db.ownsAddress(common.ExtractEmail(old.Headers.Get("From"))) {
+			return nil, &enn.NNTPError{Code: 441, Msg: "Not the author of " + id}
+		}
+		for _, g := range strings.Split(old.Headers.Get("Newsgroups"), ",") {
+			if g = strings.TrimSpace(g); g != "" && !common.ContainsString(groups, g) {
+				groups = append(groups, g)
+			}
+		}
+		olds = append(olds, msgID)
+	}
+
+	article.Header.Set("Newsgroups", strings.Join(groups, ","))
+	return olds, nil
+}
+
+// canCancel checks a cancel or supersede article against the Cancel-Lock of
+// the old article: either the client presents a matching Cancel-Key, or
+// the poster is the user that the server's own lock was made for.
+func (db *Backend) canCancel(old *common.Article, oldID string, article *enn.Article) bool {
+	locks := old.Headers.Get("Cancel-Lock")
+	if locks == "" {
+		return false
+	}
+	if enn.VerifyCancelKey(locks, article.Header.Get("Cancel-Key")) {
+		return true
+	}
+	user := db.lockUser()
+	if user == "" {
+		return false
+	}
+	key := enn.MakeCancelKey([]byte(db.Config.CancelSecret), oldID, user)
+	return enn.VerifyCancelKey(locks, "sha256:"+key)
+}
+
+// lockUser is who server side cancel locks are made for, the authenticated
+// user. Anonymous posters share addresses behind NATs and proxies, they get
+// no lock and rely on the Cancel-Lock of their client.
+func (db *Backend) lockUser() string {
+	if db.AuthObject != nil {
+		return db.AuthObject.User
+	}
+	return ""
+}
+
+// posterID identifies the poster in mod actions: the authenticated user,
+// or the remote IP for anonymous posters.
+func (db *Backend) posterID(article *enn.Article) string {
+	if db.AuthObject != nil {
+		return db.AuthObject.User
+	}
+	if tcpaddr, ok := article.RemoteAddr.(*net.TCPAddr); ok {
+		return tcpaddr.IP.String()
+	}
+	return ""
+}
+
+// supersede tombstones the replaced articles after their new version has
+// been stored. With KeepHistory the old data stays reachable for mods.
+func (db *Backend) supersede(olds []string, newID string, by string) error {
+	for _, old := range olds {
+		ar, ok := db.internalGetArticle(old)
+		if !ok {
+			continue
+		}
+		if err := db.DeleteArticle(old); err != nil {
+			return err
+		}
+
+		act := &common.ModAction{
+			Action: "supersede",
+			MsgID:  old,
+			Target: newID,
+			By:     by,
+			Time:   time.Now().Unix(),
+		}
+		if db.Config.KeepHistory {
+			act.Ref = []int64{int64(ar.Index), ar.Offset, ar.Length}
+			db.addSuperseded(ar, newID, act.Time)
+		}
+		if err := db.writeModAction(act); err != nil {
+			return err
+		}
+		db.log.Debug("supersede", "action", act)
+	}
+	return nil
+}
+
+func (db *Backend) addSuperseded(ar *common.ArticleRef, newID string, t int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.Superseded[ar.RawMsgID] = &supersededArticle{Ref: ar, NewID: newID, Time: t}
+}
+
+// History returns the earlier revisions of an article, newest first.
+func (db *Backend) History(msgID string) []*supersededArticle {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// Follow the chain backwards: earlier revisions were superseded by later ones
+	var rv []*supersededArticle
+	seen := map[string]bool{msgID: true}
+	next := []string{msgID}
+	for len(next) > 0 {
+		id := next[0]
+		next = next[1:]
+		for _, s := range db.Superseded {
+			if old := s.Ref.MsgID(); s.NewID == id && !seen[old] {
+				seen[old] = true
+				rv = append(rv, s)
+				next = append(next, old)
+			}
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Time > rv[j].Time })
+	return rv
+}
+
+func (s *supersededArticle) String() string {
+	return fmt.Sprintf("%s => %s at %s", s.Ref.MsgID(), s.NewID, time.Unix(s.Time, 0).Format(time.RFC3339))
+}
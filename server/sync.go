@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+// syncInterval is how often writes are fsynced in batch durability mode.
+const syncInterval = time.Second
+
+// synced fsyncs f in post durability mode and marks it for the next sync
+// in batch mode, muFile is held.
+func (db *Backend) synced(f *os.File) error {
+	switch db.Config.Durability {
+	case "post":
+		return f.Sync()
+	case "batch":
+		db.Data.dirty = true
+	}
+	return nil
+}
+
+// StartSync fsyncs the files written to every syncInterval in batch mode.
+func (db *Backend) StartSync() {
+	if db.Config.Durability != "batch" {
+		return
+	}
+	go func() {
+		for range time.Tick(syncInterval) {
+			if err := db.sync(); err != nil {
+				db.log.Error("fsync", "err", err)
+			}
+		}
+	}()
+}
+
+// sync fsyncs the data before the index, so that the index does not get
+// ahead of the data it refers to.
+func (db *Backend) sync() error {
+	db.muFile.Lock()
+	defer db.muFile.Unlock()
+	if !db.Data.dirty {
+		return nil
+	}
+	if err := db.Data.Files[len(db.Data.Files)-1].Sync(); err != nil {
+		return err
+	}
+	if err := db.Index.Sync(); err != nil {
+		return err
+	}
+	db.Data.dirty = false
+	return nil
+}
+
+// tornTails are the partial writes a crash left at the end of the index and
+// the last data file, -1 when there is none. They are found on every load
+// but only cut off by trimTails, by the server when loading and by fsck
+// repairing, both holding the index lock. Other commands do not take it
+// and would cut a record the server is writing.
+type tornTails struct {
+	index int64
+	data  int64
+}
+
+var errTornTails = fmt.Errorf("torn writes at the end of the index or data, start the server or repair with -fsck first")
+
+// dataTail returns where a partial record at the end of the last data file
+// starts, -1 when there is none. Damage anywhere else is left to -fsck.
+func (db *Backend) dataTail() (int64, error) {
+	f := db.Data.Files[len(db.Data.Files)-1]
+	end, err := dataEnd(f)
+	if err == nil {
+		return -1, nil
+	}
+	st, serr := f.Stat()
+	if serr != nil {
+		return -1, serr
+	}
+	tail := make([]byte, st.Size()-end)
+	if _, serr := f.ReadAt(tail, end); serr != nil {
+		return -1, serr
+	}
+	// Both separators start the same way
+	if bytes.Contains(tail[1:], []byte(dataSep[:7])) {
+		db.log.Error("data file damaged, run -fsck", "file", f.Name(), "err", err)
+		return -1, nil
+	}
+	return end, nil
+}
+
+// trimTails cuts the torn tails found by LoadIndex off the index and the
+// last data file.
+func (db *Backend) trimTails() error {
+	db.muFile.Lock()
+	defer db.muFile.Unlock()
+	t := db.tails
+	if t == nil {
+		return nil
+	}
+	for _, tail := range []struct {
+		f   *os.File
+		end int64
+		msg string
+	}{
+		{db.Data.Files[len(db.Data.Files)-1], t.data, "partial data record trimmed"},
+		{db.Index, t.index, "index cut back to the last consistent line"},
+	} {
+		if tail.end < 0 {
+			continue
+		}
+		st, err := tail.f.Stat()
+		if err != nil {
+			return err
+		}
+		db.log.Error(tail.msg, "file", tail.f.Name(), "offset", tail.end, "bytes", st.Size()-tail.end)
+		if err := tail.f.Truncate(tail.end); err != nil {
+			return err
+		}
+	}
+	db.tails = nil
+	return nil
+}
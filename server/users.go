@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coyove/enn"
+	"github.com/coyove/enn/server/common"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// noSuchUser is compared against for unknown accounts, so they take as long
+// to reject as bad passwords.
+const noSuchUser = "$2a$10$gkOgxCxGqFb7UXB6fiUt9eNvzoLJnRQgdO5/.VQHeFo.EQ4ia22ru"
+
+func hashPassword(pass string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	return string(h), err
+}
+
+// isPasswordHash tells bcrypt hashes from plaintext passwords of old records.
+func isPasswordHash(pass string) bool {
+	_, err := bcrypt.Cost([]byte(pass))
+	return err == nil
+}
+
+// setUser adds, updates or removes (Deleted) an account, replaying U records.
+func (db *Backend) setUser(u *common.UserInfo) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if u.Deleted {
+		delete(db.Users, u.Name)
+		return
+	}
+	db.Users[u.Name] = u
+}
+
+func (db *Backend) writeUser(u *common.UserInfo) error {
+	buf := bytes.NewBufferString("\nU")
+	json.NewEncoder(buf).Encode(u)
+	return db.writeIndex(buf.Bytes())
+}
+
+func (db *Backend) getUser(name string) *common.UserInfo {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.Users[name]
+}
+
+// login checks the password of an account and records the login time.
+func (db *Backend) login(name, pass string) (*enn.Identity, error) {
+	u := db.getUser(name)
+	hash := noSuchUser
+	if u != nil {
+		hash = u.Password
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)); err != nil || u == nil || u.Disabled {
+		db.log.Debug("account rejected", "user", name, "exists", u != nil)
+		return nil, enn.ErrAuthRejected
+	}
+	return db.touchLogin(u), nil
+}
+
+// loginCert logs in the account named by a verified client certificate.
+func (db *Backend) loginCert(name string) (*enn.Identity, error) {
+	u := db.getUser(name)
+	if u == nil || u.Disabled {
+		return nil, enn.ErrAuthRejected
+	}
+	return db.touchLogin(u), nil
+}
+
+// touchLogin records the login time of u in an L record, which is much
+// smaller than the U record. Compact folds them into the U records.
+func (db *Backend) touchLogin(u *common.UserInfo) *enn.Identity {
+	now := time.Now().Unix()
+	if err := db.writeIndex([]byte(fmt.Sprintf("\nL%d %s", now, u.Name))); err != nil {
+		db.log.Error("login: write last login", "user", u.Name, "err", err)
+	} else {
+		db.setLastLogin(u.Name, now)
+	}
+	return &enn.Identity{User: u.Name, Role: u.Role}
+}
+
+// setLastLogin sets the login time of an account, replaying L records.
+func (db *Backend) setLastLogin(name string, t int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if u := db.Users[name]; u != nil {
+		// Replaced, not changed, sessions may be reading it
+		u2 := *u
+		u2.LastLogin = t
+		db.Users[name] = &u2
+	}
+}
+
+// migrateMods turns the plaintext m records into mod accounts, then blanks
+// them out in the index at offsets.
+func (db *Backend) migrateMods(mods map[string]*common.ModInfo, offsets [][2]int64) error {
+	for _, m := range mods {
+		if db.Users[m.Email] != nil {
+			continue
+		}
+		hash, err := hashPassword(m.Password)
+		if err != nil {
+			return err
+		}
+		u := &common.UserInfo{Name: m.Email, Password: hash, Role: common.RoleMod}
+		if err := db.writeUser(u); err != nil {
+			return err
+		}
+		db.Users[u.Name] = u
+		db.log.Info("migrated mod to account", "user", u.Name)
+	}
+	return db.blankLines(offsets)
+}
+
+// blankLines blanks out the index lines at offsets, given as offset and
+// length, so they are skipped by future loadings.
+func (db *Backend) blankLines(offsets [][2]int64) error {
+	for _, o := range offsets {
+		if _, err := db.Index.WriteAt(bytes.Repeat([]byte(" "), int(o[1])), o[0]); err != nil {
+			return err
+		}
+	}
+	if len(offsets) > 0 {
+		return db.Index.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLastLogin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idx")
+	hash, _ := hashPassword("password")
+	db := openTestDB(t, path, "a.example", `U{"Name":"alice","Password":"`+hash+`","Role":"user"}`)
+
+	before, _ := ioutil.ReadFile(path)
+	if _, err := db.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := ioutil.ReadFile(path)
+	if added := string(after[len(before):]); !strings.HasPrefix(added, "\nL") || strings.Contains(added, hash) {
+		t.Fatalf("login recorded as %q", added)
+	}
+	last := db.getUser("alice").LastLogin
+	if last == 0 {
+		t.Fatal("last login not set")
+	}
+
+	closeTestDB(db)
+	db = openTestDB(t, path, "a.example")
+	if u := db.getUser("alice"); u.LastLogin != last || u.Password != hash {
+		t.Fatalf("bad account after reload: %+v", u)
+	}
+}
+
+func TestRoleFollowsAccount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idx")
+	hash, _ := hashPassword("password")
+	db := openTestDB(t, path, "a.example",
+		`G{"Name":"test.mods","MaxLives":100,"Read":"@mod"}`,
+		`U{"Name":"bob","Password":"`+hash+`","Role":"mod"}`)
+
+	b, err := db.Authenticate("bob", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := b.(*Backend)
+	if !sess.IsMod() {
+		t.Fatal("not a mod")
+	}
+	if _, err := sess.GetGroup("test.mods"); err != nil {
+		t.Fatal(err)
+	}
+
+	u := *db.getUser("bob")
+	u.Role = "user"
+	db.setUser(&u)
+	if sess.IsMod() {
+		t.Fatal("still a mod after being demoted")
+	}
+	if _, err := sess.GetGroup("test.mods"); err == nil {
+		t.Fatal("mod group still readable after being demoted")
+	}
+
+	u.Role, u.Disabled = "mod", true
+	db.setUser(&u)
+	if sess.IsMod() {
+		t.Fatal("disabled account still a mod")
+	}
+}
+
+func TestRegisterName(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "idx"), "a.example")
+	inv, err := db.NewInvite("mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Register(inv.Code, "ceo@example.com", "password"); err == nil {
+		t.Fatal("registered an email address")
+	}
+	if err := db.Register(inv.Code, "alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if db.accountOf("alice@a.example") != nil || len(db.getUser("alice").Emails()) != 0 {
+		t.Fatal("registered name owns addresses")
+	}
+}
@@ -0,0 +1,191 @@
+package enn
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo is a snapshot of a connected session.
+type SessionInfo struct {
+	ID       int64
+	Remote   string
+	User     string `json:",omitempty"`
+	Group    string `json:",omitempty"`
+	Start    time.Time
+	LastCmd  string `json:",omitempty"`
+	Commands int64
+	BytesIn  int64
+	BytesOut int64
+}
+
+func (s *Server) unregister(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sess.id)
+}
+
+// Sessions returns the connected sessions ordered by ID.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	list := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		list = append(list, sess)
+	}
+	s.mu.Unlock()
+
+	rv := make([]SessionInfo, 0, len(list))
+	for _, sess := range list {
+		rv = append(rv, sess.info())
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].ID < rv[j].ID })
+	return rv
+}
+
+// Kill disconnects a session, it returns false if there is no such session.
+func (s *Server) Kill(id int64) bool {
+	s.mu.Lock()
+	sess := s.sessions[id]
+	s.mu.Unlock()
+	if sess == nil {
+		return false
+	}
+	sess.log.Info("killed")
+	sess.conn.Close()
+	return true
+}
+
+func (sess *session) info() SessionInfo {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return SessionInfo{
+		ID:       sess.id,
+		Remote:   sess.conn.RemoteAddr().String(),
+		User:     sess.user,
+		Group:    sess.groupName,
+		Start:    sess.start,
+		LastCmd:  sess.lastCmd,
+		Commands: atomic.LoadInt64(&sess.commands),
+		BytesIn:  atomic.LoadInt64(&sess.cc.in),
+		BytesOut: atomic.LoadInt64(&sess.cc.out),
+	}
+}
+
+func (sess *session) setGroup(g *Group) {
+	sess.group = g
+	sess.mu.Lock()
+	sess.groupName = g.Name
+	sess.mu.Unlock()
+}
+
+func (sess *session) setUser(user string) {
+	sess.mu.Lock()
+	sess.user = user
+	sess.mu.Unlock()
+}
+
+func (sess *session) setCommand(line string) {
+	atomic.AddInt64(&sess.commands, 1)
+	sess.mu.Lock()
+	sess.lastCmd = line
+	sess.mu.Unlock()
+}
+
+// limitKey groups clients for MaxConnsPerIP, IPv6 clients by their /64.
+func limitKey(addr net.Addr) (net.IP, string) {
+	tcpaddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, ""
+	}
+	if ip4 := tcpaddr.IP.To4(); ip4 != nil {
+		return ip4, ip4.String()
+	}
+	return tcpaddr.IP, tcpaddr.IP.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// admit registers a new session unless it exceeds MaxConns or MaxConnsPerIP.
+func (s *Server) admit(sess *session) error {
+	ip, key := limitKey(sess.conn.RemoteAddr())
+	sess.ipKey = key
+	sess.exempt = ip != nil && s.LimitExempt != nil && s.LimitExempt(ip)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !sess.exempt {
+		if s.MaxConns > 0 && len(s.sessions) >= s.MaxConns {
+			return ErrTooManyConns
+		}
+		if n := 0; s.MaxConnsPerIP > 0 && key != "" {
+			for _, o := range s.sessions {
+				if o.ipKey == key {
+					n++
+				}
+			}
+			if n >= s.MaxConnsPerIP {
+				return &NNTPError{400, "Too many connections from " + key}
+			}
+		}
+	}
+	if s.sessions == nil {
+		s.sessions = map[int64]*session{}
+	}
+	s.sessions[sess.id] = sess
+	return nil
+}
+
+// admitUser records the user of an authenticated session unless it exceeds
+// MaxConnsPerUser.
+func (s *Server) admitUser(sess *session, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := 0; !sess.exempt && s.MaxConnsPerUser > 0 {
+		for _, o := range s.sessions {
+			if o != sess && o.userName() == user {
+				n++
+			}
+		}
+		if n >= s.MaxConnsPerUser {
+			return &NNTPError{400, "Too many connections for " + user}
+		}
+	}
+	sess.setUser(user)
+	return nil
+}
+
+func (sess *session) userName() string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.user
+}
+
+// authenticateCert completes the TLS handshake and logs the session in if
+// the client sent a verified certificate.
+func (sess *session) authenticateCert(tc *tls.Conn) error {
+	tc.SetDeadline(time.Now().Add(30 * time.Second))
+	defer tc.SetDeadline(time.Time{})
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	st := tc.ConnectionState()
+	cb, ok := sess.backend.(CertBackend)
+	if !ok || len(st.VerifiedChains) == 0 {
+		return nil
+	}
+
+	user, b, err := cb.AuthenticateCert(st.PeerCertificates[0])
+	if err != nil {
+		// Carry on as an anonymous session
+		sess.log.Info("certificate rejected", "subject", st.PeerCertificates[0].Subject, "err", err)
+		return nil
+	}
+	if err := sess.server.admitUser(sess, user); err != nil {
+		return err
+	}
+	if b != nil {
+		sess.backend = b
+	}
+	sess.log.Info("certificate accepted", "user", user)
+	return nil
+}
@@ -0,0 +1,150 @@
+package enn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coyove/enn/server/common"
+)
+
+func TestSessions(t *testing.T) {
+	s := NewServer(nil)
+	common.Log.SetOutput(ioutil.Discard, false, common.LevelError)
+	defer common.Log.SetOutput(os.Stdout, false, common.LevelInfo)
+
+	a, b := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		s.Process(a)
+		done <- true
+	}()
+
+	c := textproto.NewConn(b)
+	c.ReadCodeLine(200)
+	c.PrintfLine("DATE")
+	if _, _, err := c.ReadCodeLine(111); err != nil {
+		t.Fatal(err)
+	}
+
+	list := s.Sessions()
+	if len(list) != 1 || list[0].Commands != 1 || list[0].LastCmd != "DATE" || list[0].BytesIn != 6 {
+		t.Fatalf("%+v", list)
+	}
+	if s.Kill(list[0].ID+1) || !s.Kill(list[0].ID) {
+		t.Fatal("kill")
+	}
+	<-done
+	if len(s.Sessions()) != 0 {
+		t.Fatal(s.Sessions())
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	common.Log.SetOutput(ioutil.Discard, false, common.LevelError)
+	defer common.Log.SetOutput(os.Stdout, false, common.LevelInfo)
+
+	s := NewServer(nil)
+	s.MaxConns = 1
+
+	dial := func() *textproto.Conn {
+		a, b := net.Pipe()
+		go s.Process(a)
+		return textproto.NewConn(b)
+	}
+	c1 := dial()
+	if _, _, err := c1.ReadCodeLine(200); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := dial().ReadCodeLine(200); err == nil || err.(*textproto.Error).Code != 400 {
+		t.Fatal(err)
+	}
+
+	for addr, key := range map[string]string{
+		"1.2.3.4:119":         "1.2.3.4",
+		"[::ffff:1.2.3.4]:1":  "1.2.3.4",
+		"[2001:db8::1]:119":   "2001:db8::/64",
+		"[2001:db8::2:1]:119": "2001:db8::/64",
+		"[2001:db8:0:1::]:1":  "2001:db8:0:1::/64",
+	} {
+		a, _ := net.ResolveTCPAddr("tcp", addr)
+		if _, k := limitKey(a); k != key {
+			t.Fatal(addr, k)
+		}
+	}
+}
+
+type certBackend struct{ Backend }
+
+func (certBackend) AuthenticateCert(cert *x509.Certificate) (string, Backend, error) {
+	if cert.Subject.CommonName != "bot" {
+		return "", nil, ErrAuthRejected
+	}
+	return "bot", nil, nil
+}
+
+func selfSigned(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertAuth(t *testing.T) {
+	common.Log.SetOutput(ioutil.Discard, false, common.LevelError)
+	defer common.Log.SetOutput(os.Stdout, false, common.LevelInfo)
+
+	s := NewServer(certBackend{})
+	serverCert := selfSigned(t, "server")
+	pool := x509.NewCertPool()
+
+	for _, cn := range []string{"bot", "ghost", ""} {
+		var certs []tls.Certificate
+		if cn != "" {
+			cert := selfSigned(t, cn)
+			c, _ := x509.ParseCertificate(cert.Certificate[0])
+			pool.AddCert(c)
+			certs = append(certs, cert)
+		}
+
+		a, b := net.Pipe()
+		go s.Process(tls.Server(a, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		}))
+		c := textproto.NewConn(tls.Client(b, &tls.Config{InsecureSkipVerify: true, Certificates: certs}))
+		if _, _, err := c.ReadCodeLine(200); err != nil {
+			t.Fatal(cn, err)
+		}
+
+		c.PrintfLine("AUTHINFO USER x")
+		code, _, _ := c.ReadCodeLine(0)
+		if want := map[string]int{"bot": 502, "ghost": 381, "": 381}[cn]; code != want {
+			t.Fatal(cn, code)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,38 @@
+package enn
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchWildmat reports whether name matches an RFC 3977 wildmat: a comma
+// separated list of patterns using "*" and "?", each optionally
+// negated by a leading "!". The last pattern that matches decides, so
+// "comp.*,!comp.os.*" matches comp.lang.go but not comp.os.linux.
+func MatchWildmat(wildmat, name string) bool {
+	matched := false
+	for _, pat := range strings.Split(wildmat, ",") {
+		pat = strings.TrimSpace(pat)
+		neg := strings.HasPrefix(pat, "!")
+		if neg {
+			pat = pat[1:]
+		}
+		if pat == "" {
+			continue
+		}
+		if ok, err := path.Match(pat, name); err == nil && ok {
+			matched = !neg
+		}
+	}
+	return matched
+}
+
+// MatchWildmatAny reports whether any of names matches wildmat.
+func MatchWildmatAny(wildmat string, names []string) bool {
+	for _, n := range names {
+		if MatchWildmat(wildmat, n) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package enn
+
+import "testing"
+
+func TestWildmat(t *testing.T) {
+	for _, e := range []struct {
+		wildmat, name string
+		match         bool
+	}{
+		{"*", "a.b", true},
+		{"comp.*", "comp.lang.go", true},
+		{"comp.*", "alt.comp", false},
+		{"comp.*,!comp.os.*", "comp.lang.go", true},
+		{"comp.*,!comp.os.*", "comp.os.linux", false},
+		{"!comp.os.*,comp.*", "comp.os.linux", true},
+		{"a.?", "a.b", true},
+		{"a.?", "a.bc", false},
+		{"", "a.b", false},
+	} {
+		if MatchWildmat(e.wildmat, e.name) != e.match {
+			t.Fatalf("MatchWildmat(%q, %q) != %v", e.wildmat, e.name, e.match)
+		}
+	}
+}
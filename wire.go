@@ -0,0 +1,279 @@
+package enn
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"sort"
+)
+
+/*
+   Articles are passed between the protocol layer and the backend in
+   canonical form: the octets of the article as sent on the wire, with
+   dot-stuffing and the terminating ".CRLF" removed.
+
+   - Every line, in headers and body, is terminated by CRLF. A bare LF
+     received from a client is taken as a line ending and normalized.
+   - Other octets, including 8-bit ones and bare CRs, are kept verbatim.
+   - NUL is not allowed anywhere in an article (RFC 5536 section 2.2).
+
+   Writing an article back through a DotWriter re-applies dot-stuffing,
+   so a body stored in canonical form round trips byte for byte.
+*/
+
+var crlf = []byte("\r\n")
+
+// ErrNulInArticle is returned when a received article contains a NUL octet.
+var ErrNulInArticle = &NNTPError{441, "NUL character in article"}
+
+// ErrMalformedHeader is returned when a received article's headers can't be parsed.
+var ErrMalformedHeader = &NNTPError{441, "Malformed article header"}
+
+// readDotBlock reads a dot-terminated block from r and returns it in
+// canonical form. If max > 0 and the block grows beyond max octets, the
+// rest of it is read and discarded so the stream stays in sync, and
+// ErrPostingTooLarge is returned.
+func readDotBlock(r *bufio.Reader, max int64) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	hasNul, tooLarge := false, false
+	exceeds := func(n int) bool { return max > 0 && int64(buf.Len()+n) > max }
+
+	var line []byte
+	long := false
+	for {
+		frag, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Long line, keep it only while it fits in the limit
+			long = true
+			if !tooLarge {
+				line = append(line, frag...)
+				tooLarge = exceeds(len(line))
+			}
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = append(line, frag...)
+
+		l := bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+		line = line[:0]
+		// The tail of a long line is never the terminator, even when the
+		// dropped part of it left only a dot
+		atStart := !long
+		long = false
+		if atStart && len(l) == 1 && l[0] == '.' {
+			break
+		}
+		if atStart && len(l) > 0 && l[0] == '.' {
+			l = l[1:]
+		}
+		if tooLarge = tooLarge || exceeds(len(l)+2); tooLarge {
+			continue
+		}
+		if bytes.IndexByte(l, 0) > -1 {
+			hasNul = true
+		}
+		buf.Write(l)
+		buf.Write(crlf)
+	}
+	if tooLarge {
+		return nil, ErrPostingTooLarge
+	}
+	if hasNul {
+		return nil, ErrNulInArticle
+	}
+	return buf.Bytes(), nil
+}
+
+// parseArticle splits a canonical article into its headers and body.
+func parseArticle(raw []byte) (*Article, error) {
+	var head, body []byte
+	if bytes.HasPrefix(raw, crlf) {
+		head, body = crlf, raw[2:]
+	} else if idx := bytes.Index(raw, []byte("\r\n\r\n")); idx > -1 {
+		head, body = raw[:idx+4], raw[idx+4:]
+	} else {
+		head = append(append([]byte{}, raw...), crlf...)
+	}
+	rawHeader := append([]byte{}, head[:len(head)-2]...)
+
+	hdr, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(head))).ReadMIMEHeader()
+	if err != nil {
+		return nil, ErrMalformedHeader
+	}
+
+	return &Article{
+		Header:    hdr,
+		RawHeader: rawHeader,
+		Body:      bytes.NewReader(body),
+		Bytes:     len(raw),
+		Lines:     bytes.Count(body, []byte("\n")),
+	}, nil
+}
+
+// readArticle reads a dot-terminated article sent after a 340/335 response.
+func readArticle(c *textproto.Conn, max int64) (*Article, error) {
+	raw, err := readDotBlock(c.R, max)
+	if err != nil {
+		return nil, err
+	}
+	return parseArticle(raw)
+}
+
+func sortedKeys(h textproto.MIMEHeader) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A rawField is a header field as received, with its continuation lines.
+type rawField struct {
+	key, value string
+	text       []byte
+}
+
+// splitHeader splits a raw header block into its fields, unfolded the
+// way textproto does.
+func splitHeader(raw []byte) []rawField {
+	var fields []rawField
+	for len(raw) > 0 {
+		end := bytes.Index(raw, crlf)
+		if end == -1 {
+			end = len(raw)
+		} else {
+			end += 2
+		}
+		// Continuation lines start with a space or a tab
+		for end < len(raw) && (raw[end] == ' ' || raw[end] == '\t') {
+			if i := bytes.Index(raw[end:], crlf); i > -1 {
+				end += i + 2
+			} else {
+				end = len(raw)
+			}
+		}
+		text := raw[:end]
+		raw = raw[end:]
+
+		h, err := textproto.NewReader(bufio.NewReader(io.MultiReader(
+			bytes.NewReader(text), bytes.NewReader(crlf)))).ReadMIMEHeader()
+		if err != nil || len(h) != 1 {
+			continue
+		}
+		for k, v := range h {
+			fields = append(fields, rawField{key: k, value: v[0], text: text})
+		}
+	}
+	return fields
+}
+
+// headerBlock returns h on the wire, without the blank line separating it
+// from the body. Headers whose values are those of raw are written as they
+// appear in raw, the others after them in canonical form, sorted by name.
+func headerBlock(h textproto.MIMEHeader, raw []byte) []byte {
+	fields := splitHeader(raw)
+	same := sameFields(h, fields)
+
+	buf := &bytes.Buffer{}
+	for _, f := range fields {
+		if same[f.key] {
+			buf.Write(f.text)
+		}
+	}
+	for _, k := range sortedKeys(h) {
+		if same[k] {
+			continue
+		}
+		for _, v := range h[k] {
+			fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// sameFields reports for each header in fields whether h has the same
+// values for it, written as they appear in fields by headerBlock.
+func sameFields(h textproto.MIMEHeader, fields []rawField) map[string]bool {
+	got := map[string][]string{}
+	for _, f := range fields {
+		got[f.key] = append(got[f.key], f.value)
+	}
+	same := map[string]bool{}
+	for k, vs := range got {
+		same[k] = len(vs) == len(h[k])
+		for i := 0; same[k] && i < len(vs); i++ {
+			same[k] = vs[i] == h[k][i]
+		}
+	}
+	return same
+}
+
+// PackRawHeader returns the part of raw that headerBlock needs beside h, for
+// storing next to h. Fields h has other values for are dropped, those
+// written as "Name: value" are reduced to their name.
+func PackRawHeader(h textproto.MIMEHeader, raw []byte) []byte {
+	fields := splitHeader(raw)
+	same := sameFields(h, fields)
+	buf := &bytes.Buffer{}
+	for _, f := range fields {
+		if !same[f.key] {
+			continue
+		}
+		name := f.text[:bytes.IndexByte(f.text, ':')]
+		if string(f.text) == string(name)+": "+f.value+"\r\n" {
+			buf.Write(name)
+			buf.Write(crlf)
+		} else {
+			buf.Write(f.text)
+		}
+	}
+	return buf.Bytes()
+}
+
+// UnpackRawHeader restores the raw header block packed by PackRawHeader
+// with the same h.
+func UnpackRawHeader(h textproto.MIMEHeader, packed []byte) []byte {
+	buf := &bytes.Buffer{}
+	seen := map[string]int{}
+	for _, line := range bytes.SplitAfter(packed, crlf) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			buf.Write(line)
+			continue
+		}
+		name, reduced := bytes.TrimSuffix(line, crlf), true
+		if i := bytes.IndexByte(name, ':'); i > -1 {
+			name, reduced = name[:i], false
+		}
+		k := textproto.CanonicalMIMEHeaderKey(string(name))
+		n := seen[k]
+		seen[k]++
+		if !reduced {
+			buf.Write(line)
+		} else if n < len(h[k]) {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, h[k][n])
+		}
+	}
+	return buf.Bytes()
+}
+
+// writeHeader writes h as headerBlock does.
+func writeHeader(w io.Writer, h textproto.MIMEHeader, raw []byte) (int, error) {
+	return w.Write(headerBlock(h, raw))
+}
+
+// HeaderSize returns the number of octets h occupies on the wire, used
+// by backends to compute Article.Bytes as len(headers) + 2 + len(body).
+func HeaderSize(h textproto.MIMEHeader, raw []byte) int {
+	return len(headerBlock(h, raw))
+}
@@ -0,0 +1,159 @@
+package enn
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestReadDotBlock(t *testing.T) {
+	in := "From: a <a@b.c>\r\nSubject: hi\r\n\r\n..leading dot\r\nbare lf\n8-bit \xe4\xbd\xa0\r\n\r\n.\r\nnext"
+	want := "From: a <a@b.c>\r\nSubject: hi\r\n\r\n.leading dot\r\nbare lf\r\n8-bit \xe4\xbd\xa0\r\n\r\n"
+
+	r := bufio.NewReader(strings.NewReader(in))
+	raw, err := readDotBlock(r, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != want {
+		t.Fatalf("got %q, wanted %q", raw, want)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "next" {
+		t.Fatalf("terminator not consumed properly, rest %q", rest)
+	}
+
+	a, err := parseArticle(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Header.Get("Subject") != "hi" || a.Bytes != len(want) || a.Lines != 4 {
+		t.Fatalf("bad article: %v %d %d", a.Header, a.Bytes, a.Lines)
+	}
+
+	// Write it back the way ARTICLE does and read it again
+	out := &bytes.Buffer{}
+	w := textproto.NewWriter(bufio.NewWriter(out))
+	dw := w.DotWriter()
+	writeHeader(dw, a.Header, a.RawHeader)
+	dw.Write(crlf)
+	body, _ := ioutil.ReadAll(a.Body)
+	dw.Write(body)
+	dw.Close()
+
+	raw2, err := readDotBlock(bufio.NewReader(out), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, raw2) {
+		t.Fatalf("round trip mismatch: %q <-> %q", raw, raw2)
+	}
+	if n := HeaderSize(a.Header, a.RawHeader) + 2 + len(body); n != a.Bytes {
+		t.Fatalf("HeaderSize mismatch: %d, wanted %d", n, a.Bytes)
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	head := "subject: hi\r\nFROM: a <a@b.c>\r\nX-Folded: one\r\n\ttwo\r\n  three\r\nnewsgroups: a.b\r\nX-Folded: again\r\n"
+	raw := []byte(head + "\r\nbody\r\n")
+	a, err := parseArticle(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := a.Header["X-Folded"]; len(v) != 2 || v[0] != "one two three" {
+		t.Fatalf("bad unfolding: %q", v)
+	}
+
+	out := &bytes.Buffer{}
+	writeHeader(out, a.Header, a.RawHeader)
+	if out.String() != head {
+		t.Fatalf("got %q, wanted %q", out, head)
+	}
+	if n := HeaderSize(a.Header, a.RawHeader) + 2 + len("body\r\n"); n != a.Bytes {
+		t.Fatalf("HeaderSize mismatch: %d, wanted %d", n, a.Bytes)
+	}
+
+	// Changed and added headers follow the unchanged ones
+	a.Header.Set("Subject", "bye")
+	a.Header.Set("Path", "x")
+	out.Reset()
+	writeHeader(out, a.Header, a.RawHeader)
+	want := "FROM: a <a@b.c>\r\nX-Folded: one\r\n\ttwo\r\n  three\r\nnewsgroups: a.b\r\nX-Folded: again\r\nPath: x\r\nSubject: bye\r\n"
+	if out.String() != want {
+		t.Fatalf("got %q, wanted %q", out, want)
+	}
+
+	// Packed, only what differs from the header is kept
+	packed := PackRawHeader(a.Header, a.RawHeader)
+	wantPacked := "FROM\r\nX-Folded: one\r\n\ttwo\r\n  three\r\nnewsgroups\r\nX-Folded\r\n"
+	if string(packed) != wantPacked {
+		t.Fatalf("packed %q, wanted %q", packed, wantPacked)
+	}
+	out.Reset()
+	writeHeader(out, a.Header, UnpackRawHeader(a.Header, packed))
+	if out.String() != want {
+		t.Fatalf("unpacked got %q, wanted %q", out, want)
+	}
+}
+
+func TestReadDotBlockNul(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("Subject: x\r\n\r\na\x00b\r\n.\r\nnext"))
+	if _, err := readDotBlock(r, 0); err != ErrNulInArticle {
+		t.Fatalf("got %v, wanted %v", err, ErrNulInArticle)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "next" {
+		t.Fatalf("stream out of sync, rest %q", rest)
+	}
+}
+
+func TestReadDotBlockTooLarge(t *testing.T) {
+	in := "Subject: x\r\n\r\n" + strings.Repeat("0123456789\r\n", 10) + ".\r\nnext"
+	r := bufio.NewReader(strings.NewReader(in))
+	if _, err := readDotBlock(r, 64); err != ErrPostingTooLarge {
+		t.Fatalf("got %v, wanted %v", err, ErrPostingTooLarge)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "next" {
+		t.Fatalf("stream out of sync, rest %q", rest)
+	}
+
+	r = bufio.NewReader(strings.NewReader(in))
+	if raw, err := readDotBlock(r, int64(len(in)-len(".\r\nnext"))); err != nil {
+		t.Fatalf("article at the limit rejected: %v, %d", err, len(raw))
+	}
+
+	long := "Subject: x\r\n\r\n" + strings.Repeat("x", 10000) + "\r\n.\r\nnext"
+	r = bufio.NewReader(strings.NewReader(long))
+	if raw, err := readDotBlock(r, 0); err != nil || len(raw) != len(long)-len(".\r\nnext") {
+		t.Fatalf("long line: %v, %d", err, len(raw))
+	}
+	r = bufio.NewReader(strings.NewReader(long))
+	if _, err := readDotBlock(r, 5000); err != ErrPostingTooLarge {
+		t.Fatalf("long line: got %v, wanted %v", err, ErrPostingTooLarge)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "next" {
+		t.Fatalf("stream out of sync, rest %q", rest)
+	}
+}
+
+func TestReadDotBlockLongLineDot(t *testing.T) {
+	// Once over the limit long lines are dropped, whatever the alignment
+	// the tail of one ending in a dot is not taken as the terminator
+	for k := 16; k < 64; k++ {
+		in := "Subject: x\r\n\r\n0123456789\r\n" + strings.Repeat("x", k) + ".\r\nmore\r\n.\r\nnext"
+		r := bufio.NewReaderSize(strings.NewReader(in), 16)
+		if _, err := readDotBlock(r, 20); err != ErrPostingTooLarge {
+			t.Fatalf("%d: got %v, wanted %v", k, err, ErrPostingTooLarge)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "next" {
+			t.Fatalf("%d: stream out of sync, rest %q", k, rest)
+		}
+
+		r = bufio.NewReaderSize(strings.NewReader(in), 16)
+		raw, err := readDotBlock(r, 0)
+		if want := in[:len(in)-len(".\r\nnext")]; err != nil || string(raw) != want {
+			t.Fatalf("%d: got %q, %v, wanted %q", k, raw, err, want)
+		}
+	}
+}